@@ -2,18 +2,30 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/marevers/energia/pkg/axpert"
+	"github.com/marevers/energia/pkg/connector"
 	log "github.com/sirupsen/logrus"
 )
 
-// Represents the JSON body for control API commands
+// Represents the JSON body for control API commands. The parallel id selects a unit of a parallel
+// cluster for commands that support it and defaults to the unit of the inverter itself.
 type CommandRequest struct {
-	Value    string `json:"value"`
-	SerialNo string `json:"serialno"`
+	Value      string `json:"value"`
+	SerialNo   string `json:"serialno"`
+	ParallelID *int   `json:"parallelid,omitempty"`
+	Flag       string `json:"flag,omitempty"`
+
+	// Only previews the effect of commands that support it, without executing them
+	DryRun bool `json:"dryrun,omitempty"`
 }
 
 // Represents the JSON body for settings requests
@@ -27,17 +39,57 @@ type SettingsResponse struct {
 	Settings CurrentSettings `json:"settings"`
 }
 
+// Represents the JSON body for schema responses
+type SchemaResponse struct {
+	Settings []Setting `json:"settings"`
+}
+
+// Represents the JSON body for warnings requests
+type WarningsRequest struct {
+	SerialNo string `json:"serialno"`
+}
+
+// Represents the JSON body for warnings responses
+type WarningsResponse struct {
+	SerialNo string          `json:"serialno"`
+	Warnings []ActiveWarning `json:"warnings"`
+}
+
+// Represents the JSON body for energy requests. The date defaults to today.
+type EnergyRequest struct {
+	SerialNo string `json:"serialno"`
+	Date     string `json:"date"`
+}
+
+// Represents the JSON body for energy responses. The energy in kWh is keyed by period (total, year,
+// month or day); periods the inverter does not support are left out.
+type EnergyResponse struct {
+	SerialNo string             `json:"serialno"`
+	Date     string             `json:"date"`
+	PV       map[string]float64 `json:"pv"`
+	Load     map[string]float64 `json:"load"`
+}
+
 // Represents the JSON response for control API commands
 type CommandResponse struct {
-	Command string `json:"command"`
-	Value   string `json:"value"`
-	Status  string `json:"status"`
-	Message string `json:"message"`
+	Command   string            `json:"command"`
+	Value     string            `json:"value"`
+	Status    string            `json:"status"`
+	Message   string            `json:"message"`
+	Overrides []SettingOverride `json:"overrides,omitempty"`
+
+	// Whether the setting read back from the inverter matches the value, set for executed commands
+	Verified *bool `json:"verified,omitempty"`
+	ReadBack any   `json:"readback,omitempty"`
 }
 
 // Represents an inverter for the API
 type InverterInfo struct {
-	SerialNo string `json:"serialno"`
+	SerialNo       string `json:"serialno"`
+	Device         string `json:"device"`
+	Connected      bool   `json:"connected"`
+	CircuitBreaker string `json:"circuitbreaker"`
+	Identity
 }
 
 // Represents the response for listing inverters
@@ -49,13 +101,29 @@ type InvertersResponse struct {
 // Defines the signature for command handler functions
 type CommandHandler func(app *Application, req CommandRequest) error
 
+// Defines the signature for functions previewing which settings a command overrides
+type CommandPreview func(app *Application, req CommandRequest) ([]SettingOverride, error)
+
+// Maps command names to their preview functions, for commands that change more than their own setting
+var commandPreviews = map[string]CommandPreview{
+	"setBatteryType": previewSetBatteryType,
+}
+
 // Maps command names to their handler functions
 var commandHandlers = map[string]CommandHandler{
-	"setOutputPriority":         handleSetOutputPriority,
-	"setChargerPriority":        handleSetChargerPriority,
-	"setBatteryRechgVoltage":    handleSetBatteryRechgVoltage,
-	"setBatteryRedischgVoltage": handleSetBatteryRedischgVoltage,
-	// "setMaxChargeCurrent": handleSetMaxChargeCurrent,
+	"setOutputPriority":          handleSetOutputPriority,
+	"setChargerPriority":         handleSetChargerPriority,
+	"setBatteryRechgVoltage":     numericSettingHandler("setBatteryRechgVoltage", setBatteryRechargeVoltage),
+	"setBatteryRedischgVoltage":  numericSettingHandler("setBatteryRedischgVoltage", setBatteryRedischargeVoltage),
+	"setBatteryFloatVoltage":     numericSettingHandler("setBatteryFloatVoltage", setBatteryFloatVoltage),
+	"setBatteryBulkVoltage":      numericSettingHandler("setBatteryBulkVoltage", setBatteryBulkVoltage),
+	"setBatteryCutoffVoltage":    numericSettingHandler("setBatteryCutoffVoltage", setBatteryCutoffVoltage),
+	"setMaxUtilityChargeCurrent": handleSetMaxUtilityChargeCurrent,
+	"setMaxChargeCurrent":        handleSetMaxChargeCurrent,
+	"setBatteryType":             handleSetBatteryType,
+	"setOutputVoltage":           handleSetOutputVoltage,
+	"setOutputFrequency":         handleSetOutputFrequency,
+	"setFlag":                    handleSetFlag,
 }
 
 // Handles control API commands
@@ -87,7 +155,54 @@ func (a *Application) handleCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Execute command
+	// Preview the settings the command overrides
+	preview, hasPreview := commandPreviews[command]
+	if req.DryRun && !hasPreview {
+		http.Error(w, "Command does not support dry runs", http.StatusBadRequest)
+		return
+	}
+
+	var overrides []SettingOverride
+	if hasPreview {
+		o, err := preview(a, req)
+		if err != nil {
+			log.Errorf("Command preview failed: %v", err)
+			response := CommandResponse{
+				Command: command,
+				Value:   req.Value,
+				Status:  "error",
+				Message: err.Error(),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		overrides = o
+		log.Infof("Command %s overrides settings: %+v", command, overrides)
+	}
+
+	if req.DryRun {
+		response := CommandResponse{
+			Command:   command,
+			Value:     req.Value,
+			Status:    "dryrun",
+			Message:   "Command not executed",
+			Overrides: overrides,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Commands wait for a running batch of the inverter, so they do not change settings the batch
+	// validated or is about to roll back
+	if inv, err := findInverterBySerial(a, req.SerialNo); err == nil {
+		inv.batch.Lock()
+		defer inv.batch.Unlock()
+	}
+
+	// Execute command. Values that fail validation are refused before anything is sent to the inverter.
 	if err := handler(a, req); err != nil {
 		log.Errorf("Command execution failed: %v", err)
 		response := CommandResponse{
@@ -96,17 +211,53 @@ func (a *Application) handleCommand(w http.ResponseWriter, r *http.Request) {
 			Status:  "error",
 			Message: err.Error(),
 		}
+
+		code := http.StatusInternalServerError
+		var verr *ValidationError
+		switch {
+		case errors.As(err, &verr):
+			code = http.StatusBadRequest
+		case errors.Is(err, errNoCurrentSettings):
+			code = http.StatusServiceUnavailable
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(code)
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 
 	response := CommandResponse{
-		Command: command,
-		Value:   req.Value,
-		Status:  "success",
-		Message: "Command executed successfully",
+		Command:   command,
+		Value:     req.Value,
+		Status:    "success",
+		Message:   "Command executed successfully",
+		Overrides: overrides,
+	}
+
+	// Some firmwares acknowledge commands without applying them, so the setting is read back
+	if s := findCommandSetting(command); s != nil {
+		readBack, err := a.readBack(s, req)
+		if err != nil {
+			log.Errorf("Failed to read back %s: %v", s.Name, err)
+		}
+
+		verified := err == nil && matchesRequest(s, req, readBack)
+		response.Verified = &verified
+		response.ReadBack = readBack
+
+		// The read back refreshed the voltages a battery type profile applied, which replace the expected ones
+		if err == nil && len(overrides) > 0 {
+			response.Overrides = a.reportedOverrides(req.SerialNo, overrides)
+		}
+
+		if !verified {
+			response.Status = "unverified"
+			response.Message = fmt.Sprintf("Command acknowledged, but the inverter reports %s of %s", s.Name, strings.TrimSpace(fmt.Sprint(readBack, " ", s.Unit)))
+			if err != nil {
+				response.Message = fmt.Sprintf("Command acknowledged, but %s could not be read back: %v", s.Name, err)
+			}
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -119,7 +270,7 @@ func (a *Application) handleCommand(w http.ResponseWriter, r *http.Request) {
 
 // Finds an inverter by its serial number
 func findInverterBySerial(app *Application, serialNo string) (*Inverter, error) {
-	for _, inv := range app.Inverters {
+	for _, inv := range app.inverterList() {
 		if inv.SerialNo == serialNo {
 			return inv, nil
 		}
@@ -127,14 +278,29 @@ func findInverterBySerial(app *Application, serialNo string) (*Inverter, error)
 	return nil, fmt.Errorf("inverter with serial number %s not found", serialNo)
 }
 
+// Returns the inverter for the API without taking the inverter lock
+func (inv *Inverter) info() InverterInfo {
+	inv.linkMu.Lock()
+	defer inv.linkMu.Unlock()
+
+	state, _ := inv.breaker.State()
+
+	return InverterInfo{
+		SerialNo:       inv.SerialNo,
+		Device:         inv.Device,
+		Connected:      inv.Connector != nil,
+		CircuitBreaker: state.String(),
+		Identity:       inv.Identity,
+	}
+}
+
 // Handles listing all available inverters
 func (a *Application) handleListInverters(w http.ResponseWriter, r *http.Request) {
-	inverters := make([]InverterInfo, 0, len(a.Inverters))
+	invs := a.inverterList()
+	inverters := make([]InverterInfo, 0, len(invs))
 
-	for _, inv := range a.Inverters {
-		inverters = append(inverters, InverterInfo{
-			SerialNo: inv.SerialNo,
-		})
+	for _, inv := range invs {
+		inverters = append(inverters, inv.info())
 	}
 
 	response := InvertersResponse{
@@ -169,17 +335,23 @@ func (a *Application) handleGetCurrentSettings(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	// Use cached current settings from the inverter struct
-	if inv.CurrentSettings == nil {
+	// Use a copy of the cached current settings, which the poller updates while it is encoded
+	inv.mu.Lock()
+	var settings *CurrentSettings
+	if inv.CurrentSettings != nil {
+		settings = inv.CurrentSettings.clone()
+	}
+	inv.mu.Unlock()
+
+	if settings == nil {
 		log.Errorf("Current settings not available for %s (may not have been collected yet)", req.SerialNo)
-		http.Error(w, "Current settings not available - please wait for next metrics collection cycle", http.StatusServiceUnavailable)
+		http.Error(w, errNoCurrentSettings.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	settings := *inv.CurrentSettings
 	response := SettingsResponse{
 		SerialNo: inv.SerialNo,
-		Settings: settings,
+		Settings: *settings,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -190,6 +362,158 @@ func (a *Application) handleGetCurrentSettings(w http.ResponseWriter, r *http.Re
 	}
 }
 
+// Handles retrieving the settings schema
+func (a *Application) handleGetSchema(w http.ResponseWriter, r *http.Request) {
+	response := SchemaResponse{
+		Settings: settingsSchema,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Failed to encode schema response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// Handles retrieving the active warnings and faults of an inverter
+func (a *Application) handleGetWarnings(w http.ResponseWriter, r *http.Request) {
+	// Parse JSON body
+	var req WarningsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Errorf("Failed to decode request body: %v", err)
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	log.Infof("Retrieving warnings for inverter with serialno '%s'", req.SerialNo)
+
+	inv, err := findInverterBySerial(a, req.SerialNo)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Use cached warnings from the inverter struct
+	inv.mu.Lock()
+	warnings := inv.Warnings
+	inv.mu.Unlock()
+
+	if warnings == nil {
+		log.Errorf("Warnings not available for %s (may not have been collected yet)", req.SerialNo)
+		http.Error(w, "Warnings not available - please wait for next metrics collection cycle", http.StatusServiceUnavailable)
+		return
+	}
+
+	response := WarningsResponse{
+		SerialNo: inv.SerialNo,
+		Warnings: warnings,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Failed to encode warnings response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// Handles reading the energy counters of the inverter firmware for a date
+func (a *Application) handleGetEnergy(w http.ResponseWriter, r *http.Request) {
+	// Parse JSON body
+	var req EnergyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Errorf("Failed to decode request body: %v", err)
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	date := time.Now()
+	if req.Date != "" {
+		d, err := time.ParseInLocation(time.DateOnly, req.Date, time.Local)
+		if err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		date = d
+	}
+
+	log.Infof("Retrieving energy counters for %s for inverter with serialno '%s'", date.Format(time.DateOnly), req.SerialNo)
+
+	inv, err := findInverterBySerial(a, req.SerialNo)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	c, err := a.conn(inv)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if inv.unsupported == nil {
+		inv.unsupported = make(map[string]bool)
+	}
+
+	response := EnergyResponse{
+		SerialNo: inv.SerialNo,
+		Date:     date.Format(time.DateOnly),
+		PV:       make(map[string]float64),
+		Load:     make(map[string]float64),
+	}
+
+	found := false
+	for _, q := range energyQueries {
+		if inv.unsupported[q.Prefix] {
+			continue
+		}
+
+		v, err := readEnergyCounter(c, q, date)
+		if errors.Is(err, errNotSupported) {
+			// Inverters also answer NAK for periods without data, so a counter is only marked as
+			// unsupported if it is refused for the current period, as the poller does
+			if date.Format(q.DateLayout) == time.Now().Format(q.DateLayout) {
+				inv.unsupported[q.Prefix] = true
+			}
+			continue
+		}
+		if err != nil {
+			log.Errorf("Failed to read energy counter %s: %v", q.Prefix, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		found = true
+		if q.Source == "pv" {
+			response.PV[q.Period] = v
+		} else {
+			response.Load[q.Period] = v
+		}
+	}
+
+	if !found {
+		if slices.ContainsFunc(energyQueries, func(q energyQuery) bool { return !inv.unsupported[q.Prefix] }) {
+			http.Error(w, "No energy counters available for "+response.Date, http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Energy counters are not supported by this inverter", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Failed to encode energy response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
 // Sets the output source priority for a specific inverter
 func handleSetOutputPriority(app *Application, req CommandRequest) error {
 	log.Infof("Setting output source priority to: %s for inverter: %s", req.Value, req.SerialNo)
@@ -202,7 +526,12 @@ func handleSetOutputPriority(app *Application, req CommandRequest) error {
 	inv.mu.Lock()
 	defer inv.mu.Unlock()
 
-	return setOutputSourcePriority(inv.Connector, req.Value)
+	c, err := app.conn(inv)
+	if err != nil {
+		return err
+	}
+
+	return setOutputSourcePriority(c, req.Value)
 }
 
 // Sets the charger source priority for a specific inverter
@@ -217,63 +546,222 @@ func handleSetChargerPriority(app *Application, req CommandRequest) error {
 	inv.mu.Lock()
 	defer inv.mu.Unlock()
 
-	return setChargerSourcePriority(inv.Connector, req.Value)
+	c, err := app.conn(inv)
+	if err != nil {
+		return err
+	}
+
+	return setChargerSourcePriority(c, req.Value)
+}
+
+// Returns a handler for the command of a numeric setting, which parses the value and passes it to
+// the function setting it together with the current settings it is validated against
+func numericSettingHandler(command string, set func(c connector.Connector, cs *CurrentSettings, v float32) error) CommandHandler {
+	return func(app *Application, req CommandRequest) error {
+		s := findCommandSetting(command)
+		log.Infof("Setting %s to: %s for inverter: %s", s.Name, req.Value, req.SerialNo)
+
+		inv, err := findInverterBySerial(app, req.SerialNo)
+		if err != nil {
+			return err
+		}
+
+		f, err := strconv.ParseFloat(req.Value, 32)
+		if err != nil {
+			return &ValidationError{Err: fmt.Errorf("invalid %s: %s", s.Name, req.Value)}
+		}
+
+		inv.mu.Lock()
+		defer inv.mu.Unlock()
+
+		c, err := app.conn(inv)
+		if err != nil {
+			return err
+		}
+
+		return set(c, inv.CurrentSettings, float32(f))
+	}
 }
 
-// Sets the battery recharge voltage for  specific inverter
-func handleSetBatteryRechgVoltage(app *Application, req CommandRequest) error {
-	log.Infof("Setting battery recharge voltage to: %s for inverter: %s", req.Value, req.SerialNo)
+// Sets the maximum utility (AC) charge current for a specific inverter
+func handleSetMaxUtilityChargeCurrent(app *Application, req CommandRequest) error {
+	log.Infof("Setting max utility charge current to: %s for inverter: %s", req.Value, req.SerialNo)
 
 	inv, err := findInverterBySerial(app, req.SerialNo)
 	if err != nil {
 		return err
 	}
 
-	f, err := strconv.ParseFloat(req.Value, 32)
+	cr, err := strconv.ParseFloat(req.Value, 64)
+	if err != nil {
+		return &ValidationError{Err: fmt.Errorf("invalid current value: %s", req.Value)}
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	c, err := app.conn(inv)
+	if err != nil {
+		return err
+	}
+
+	return setMaxUtilityChargeCurrent(c, inv.CurrentSettings, cr)
+}
+
+// Sets the maximum total charge current for a specific inverter or a unit of its parallel cluster
+func handleSetMaxChargeCurrent(app *Application, req CommandRequest) error {
+	log.Infof("Setting max charge current to: %s for inverter: %s", req.Value, req.SerialNo)
+
+	inv, err := findInverterBySerial(app, req.SerialNo)
 	if err != nil {
 		return err
 	}
 
+	cr, err := strconv.ParseFloat(req.Value, 64)
+	if err != nil {
+		return &ValidationError{Err: fmt.Errorf("invalid current value: %s", req.Value)}
+	}
+
 	inv.mu.Lock()
 	defer inv.mu.Unlock()
 
-	return setBatteryRechargeVoltage(inv.Connector, inv.CurrentSettings, float32(f))
+	c, err := app.conn(inv)
+	if err != nil {
+		return err
+	}
+
+	id := inv.parallelID()
+	if req.ParallelID != nil {
+		id = *req.ParallelID
+	}
+
+	return setMaxChargeCurrent(c, inv.CurrentSettings, cr, id)
 }
 
-// Sets the battery recharge voltage for  specific inverter
-func handleSetBatteryRedischgVoltage(app *Application, req CommandRequest) error {
-	log.Infof("Setting battery redischarge voltage to: %s for inverter: %s", req.Value, req.SerialNo)
+// Previews the voltage settings that the profile of a battery type overrides for a specific inverter
+func previewSetBatteryType(app *Application, req CommandRequest) ([]SettingOverride, error) {
+	inv, err := findInverterBySerial(app, req.SerialNo)
+	if err != nil {
+		return nil, err
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	return batteryTypeOverrides(inv.CurrentSettings, req.Value)
+}
+
+// Sets the battery type for a specific inverter
+func handleSetBatteryType(app *Application, req CommandRequest) error {
+	log.Infof("Setting battery type to: %s for inverter: %s", req.Value, req.SerialNo)
 
 	inv, err := findInverterBySerial(app, req.SerialNo)
 	if err != nil {
 		return err
 	}
 
-	f, err := strconv.ParseFloat(req.Value, 32)
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	c, err := app.conn(inv)
+	if err != nil {
+		return err
+	}
+
+	return setBatteryType(c, req.Value)
+}
+
+// Queries the device mode (QMOD) and updates the current settings with it, so commands that require a
+// device mode are validated against the mode of the inverter, not the one of the last metrics
+// collection cycle. The inverter lock must be held.
+func refreshDeviceMode(inv *Inverter, c *exchangeConnector) error {
+	md, err := observe(c, "QMOD", axpert.DeviceMode)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve device mode: %w", err)
+	}
+
+	return inv.UpdateCurrentSettings(md)
+}
+
+// Sets the output voltage for a specific inverter
+func handleSetOutputVoltage(app *Application, req CommandRequest) error {
+	log.Infof("Setting output voltage to: %s for inverter: %s", req.Value, req.SerialNo)
+
+	inv, err := findInverterBySerial(app, req.SerialNo)
 	if err != nil {
 		return err
 	}
 
+	v, err := strconv.Atoi(req.Value)
+	if err != nil {
+		return &ValidationError{Err: fmt.Errorf("invalid output voltage: %s", req.Value)}
+	}
+
 	inv.mu.Lock()
 	defer inv.mu.Unlock()
 
-	return setBatteryRedischargeVoltage(inv.Connector, inv.CurrentSettings, float32(f))
+	c, err := app.conn(inv)
+	if err != nil {
+		return err
+	}
+
+	if err := refreshDeviceMode(inv, c); err != nil {
+		return err
+	}
+
+	return setOutputVoltage(c, inv.CurrentSettings, v)
 }
 
-// Sets the maximum AC charge current for a specific inverter
-// func handleSetMaxChargeCurrent(app *Application, req CommandRequest) error {
-// 	log.Infof("Setting max charge current to: %s for inverter: %s", req.Value, req.SerialNo)
+// Sets the output frequency for a specific inverter
+func handleSetOutputFrequency(app *Application, req CommandRequest) error {
+	log.Infof("Setting output frequency to: %s for inverter: %s", req.Value, req.SerialNo)
 
-// 	// Convert string value to uint8
-// 	current, err := strconv.ParseUint(req.Value, 10, 8)
-// 	if err != nil {
-// 		return fmt.Errorf("invalid current value: %s", req.Value)
-// 	}
+	inv, err := findInverterBySerial(app, req.SerialNo)
+	if err != nil {
+		return err
+	}
 
-// 	inv, err := findInverterBySerial(app, req.SerialNo)
-// 	if err != nil {
-// 		return err
-// 	}
+	f, err := strconv.Atoi(req.Value)
+	if err != nil {
+		return &ValidationError{Err: fmt.Errorf("invalid output frequency: %s", req.Value)}
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	c, err := app.conn(inv)
+	if err != nil {
+		return err
+	}
 
-// 	return setMaxACChargeCurrent(inv.Connector, uint8(current))
-// }
+	if err := refreshDeviceMode(inv, c); err != nil {
+		return err
+	}
+
+	return setOutputFrequency(c, inv.CurrentSettings, f)
+}
+
+// Enables or disables a device flag for a specific inverter
+func handleSetFlag(app *Application, req CommandRequest) error {
+	log.Infof("Setting device flag %s to: %s for inverter: %s", req.Flag, req.Value, req.SerialNo)
+
+	inv, err := findInverterBySerial(app, req.SerialNo)
+	if err != nil {
+		return err
+	}
+
+	on, err := parseFlagValue(req.Value)
+	if err != nil {
+		return err
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	c, err := app.conn(inv)
+	if err != nil {
+		return err
+	}
+
+	return setFlag(c, inv.CurrentSettings, req.Flag, on)
+}
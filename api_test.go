@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetCurrentSettingsWhilePolling(t *testing.T) {
+	app, inv, _ := newTestApplication(t, nil)
+
+	var groups []queryGroup
+	for _, g := range queryGroups {
+		if g.Name == "rating" || g.Name == "flags" {
+			groups = append(groups, g)
+		}
+	}
+
+	// The poller updates the current settings while they are requested
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			app.CalculateMetrics(inv, groups)
+		}
+	}()
+
+	for range 20 {
+		r := httptest.NewRequest(http.MethodPost, "/api/settings", strings.NewReader(`{"serialno": "90000000000001"}`))
+		w := httptest.NewRecorder()
+		app.Routes().ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status code %d, want %d", w.Code, http.StatusOK)
+		}
+
+		var response SettingsResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Settings.BatteryType != "user" {
+			t.Errorf("got battery type %q, want user", response.Settings.BatteryType)
+		}
+	}
+
+	wg.Wait()
+}
+
+func TestSetOutputInStandby(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  string
+		value    string
+		standby  bool
+		wantCode int
+		want     func(sc *SimulatedConnector) bool
+	}{
+		{
+			name: "output voltage", command: "setOutputVoltage", value: "220", standby: true, wantCode: http.StatusOK,
+			want: func(sc *SimulatedConnector) bool { return sc.outputVoltage == 220 },
+		},
+		{
+			name: "output frequency", command: "setOutputFrequency", value: "60", standby: true, wantCode: http.StatusOK,
+			want: func(sc *SimulatedConnector) bool { return sc.outputFrequency == 60 },
+		},
+		{
+			name: "output voltage outside standby mode", command: "setOutputVoltage", value: "220", wantCode: http.StatusBadRequest,
+			want: func(sc *SimulatedConnector) bool { return sc.outputVoltage == 230 },
+		},
+		{
+			name: "output frequency outside standby mode", command: "setOutputFrequency", value: "60", wantCode: http.StatusBadRequest,
+			want: func(sc *SimulatedConnector) bool { return sc.outputFrequency == 50 },
+		},
+		{
+			name: "output voltage of another voltage class", command: "setOutputVoltage", value: "120", standby: true, wantCode: http.StatusBadRequest,
+			want: func(sc *SimulatedConnector) bool { return sc.outputVoltage == 230 },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _, sc := newTestApplication(t, func(sc *SimulatedConnector) { sc.standby = tt.standby })
+
+			body := `{"value": "` + tt.value + `", "serialno": "90000000000001"}`
+			r := httptest.NewRequest(http.MethodPost, "/api/command/"+tt.command, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			app.Routes().ServeHTTP(w, r)
+
+			var response CommandResponse
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status code %d, want %d: %s", w.Code, tt.wantCode, response.Message)
+			}
+			if w.Code == http.StatusOK && (response.Verified == nil || !*response.Verified) {
+				t.Errorf("command was not verified: %s", response.Message)
+			}
+			if !tt.want(sc) {
+				t.Errorf("got output voltage %d and frequency %d", sc.outputVoltage, sc.outputFrequency)
+			}
+		})
+	}
+}
+
+func TestAllowedOutputVoltages(t *testing.T) {
+	tests := []struct {
+		name    string
+		grid    float32
+		output  float32
+		freq    float32
+		want    []int
+		wantErr string
+	}{
+		{name: "230 V class", grid: 230, output: 240, freq: 50, want: []int{220, 230, 240}},
+		{name: "120 V class", grid: 120, output: 127, freq: 60, want: []int{110, 120, 127}},
+		{name: "unknown class", grid: 180, output: 230, freq: 50, wantErr: "unknown for a grid rating voltage of 180 V"},
+		{name: "output of another class", grid: 230, output: 120, freq: 50, wantErr: "output rating voltage of 120 V does not match"},
+		{name: "unknown frequency", grid: 230, output: 230, freq: 0, wantErr: "output rating frequency of 0 Hz does not match"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := &CurrentSettings{GridRatingVoltage: tt.grid, OutputRatingVoltage: tt.output, OutputRatingFrequency: tt.freq}
+
+			got, err := allowedOutputVoltages(cs)
+			checkErr(t, err, tt.wantErr)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got output voltages %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetEnergyForDateWithoutData(t *testing.T) {
+	app, inv, _ := newTestApplication(t, nil)
+
+	getEnergy := func(date string) int {
+		body := `{"serialno": "90000000000001", "date": "` + date + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/api/energy", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		app.Routes().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// The inverter refuses the counters of a future date, which does not disable them for the poller
+	if code := getEnergy(time.Now().AddDate(2, 0, 0).Format(time.DateOnly)); code != http.StatusOK {
+		t.Fatalf("got status code %d for a future date, want %d with the totals", code, http.StatusOK)
+	}
+	for _, q := range energyQueries {
+		if inv.unsupported[q.Prefix] {
+			t.Errorf("counter %s was marked as unsupported", q.Prefix)
+		}
+	}
+
+	if code := getEnergy(time.Now().Format(time.DateOnly)); code != http.StatusOK {
+		t.Fatalf("got status code %d for the current date, want %d", code, http.StatusOK)
+	}
+}
+
+func TestSetChargeCurrentValidatesSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(sc *SimulatedConnector) error
+		wantErr string
+	}{
+		{name: "allowed", set: func(sc *SimulatedConnector) error { return setMaxUtilityChargeCurrent(sc, nil, 20) }},
+		{
+			name:    "not a whole number",
+			set:     func(sc *SimulatedConnector) error { return setMaxUtilityChargeCurrent(sc, nil, 20.5) },
+			wantErr: "maximum AC charge current must be a whole number between 0 and 255 A",
+		},
+		{
+			name:    "out of range",
+			set:     func(sc *SimulatedConnector) error { return setMaxChargeCurrent(sc, nil, 300, 0) },
+			wantErr: "maximum charge current must be a whole number between 0 and 255 A",
+		},
+		{
+			name:    "not allowed by the inverter",
+			set:     func(sc *SimulatedConnector) error { return setMaxChargeCurrent(sc, nil, 25, 0) },
+			wantErr: "maximum charge current must be one of",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.set(NewSimulatedConnector(0))
+			checkErr(t, err, tt.wantErr)
+
+			var verr *ValidationError
+			if tt.wantErr != "" && !errors.As(err, &verr) {
+				t.Errorf("got %T, want a validation error", err)
+			}
+		})
+	}
+}
@@ -3,82 +3,302 @@ package main
 import (
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/goburrow/serial"
 	"github.com/marevers/energia/pkg/axpert"
 	"github.com/marevers/energia/pkg/connector"
+	log "github.com/sirupsen/logrus"
 )
 
-// Initialise any inverters connected through USB and return them
-func initInverters() ([]*Inverter, error) {
+// Read timeout for serial devices, matching the timeout used for USB HID reads
+const serialTimeout = 5 * time.Second
+
+// Initialise any inverters connected through USB, configured serial devices or TCP bridges and return them.
+// If rec is not nil, the traffic of all inverters is recorded.
+func initInverters(rec *Recorder) ([]*Inverter, error) {
 	var invs []*Inverter
 
+	if *simulate > 0 {
+		for i := range *simulate {
+			sc := NewSimulatedConnector(i)
+			sc.standby = *simStandby
+
+			inv, err := newInverter(sc, fmt.Sprintf("sim%d", i), rec)
+			if err != nil {
+				return nil, err
+			}
+
+			invs = append(invs, inv)
+		}
+
+		return invs, nil
+	}
+
+	if *replayFile != "" {
+		exchanges, devices, err := loadRecording(*replayFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load recording: %w", err)
+		}
+
+		for _, dev := range devices {
+			inv, err := newInverter(NewReplayConnector(dev, exchanges[dev]), dev, rec)
+			if err != nil {
+				return nil, fmt.Errorf("replay of %s: %w", dev, err)
+			}
+
+			invs = append(invs, inv)
+		}
+
+		return invs, nil
+	}
+
 	crs, err := axpert.GetUSBInverters()
 	if err != nil {
-		return nil, errors.New("no Axpert inverters found")
+		log.Warnln("no Axpert inverters found through USB:", err)
 	}
 
 	for _, cr := range crs {
-		inv := &Inverter{
-			Connector: cr,
+		inv, err := newInverter(cr, cr.Path(), rec)
+		if err != nil {
+			return nil, err
 		}
+		inv.reopen = usbOpener(cr.Path())
+
+		invs = append(invs, inv)
+	}
 
-		sn, err := axpert.SerialNo(cr)
+	for _, dev := range splitList(*serialDevices) {
+		inv, err := openInverter(serialOpener(dev), dev, rec)
 		if err != nil {
-			return nil, errors.New("failed to retrieve serial number")
+			return nil, fmt.Errorf("serial device %s: %w", dev, err)
 		}
-		inv.SerialNo = sn
 
 		invs = append(invs, inv)
 	}
 
+	for _, addr := range splitList(*tcpAddresses) {
+		inv, err := openInverter(tcpOpener(addr), addr, rec)
+		if err != nil {
+			return nil, fmt.Errorf("tcp device %s: %w", addr, err)
+		}
+
+		invs = append(invs, inv)
+	}
+
+	if len(invs) < 1 {
+		return nil, errors.New("no Axpert inverters found")
+	}
+
 	return invs, nil
 }
 
-// Takes an input and updates all relevant current settings using the contents of the input
+// Creates an inverter for an opened connector by retrieving its serial number.
+// If rec is not nil, the connector is wrapped so its traffic is recorded.
+func newInverter(cr connector.Connector, device string, rec *Recorder) (*Inverter, error) {
+	if rec != nil {
+		cr = rec.Wrap(device, cr)
+	}
+
+	inv := &Inverter{
+		Connector: cr,
+		Device:    device,
+		busy:      make(chan struct{}, 1),
+	}
+
+	c := newExchangeConnector(inv, nil)
+
+	sn, err := axpert.SerialNo(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve serial number: %w", err)
+	}
+	inv.SerialNo = sn
+	inv.Identity = queryIdentity(inv)
+
+	return inv, nil
+}
+
+// Retrieves the protocol ID, firmware versions and model of an inverter. Every query is tried once
+// and does not count toward the circuit breaker. Queries the inverter answers with NAK are marked as
+// unsupported and leave the corresponding value empty.
+func queryIdentity(inv *Inverter) Identity {
+	var id Identity
+
+	c := newExchangeConnector(inv, nil)
+	c.probe = true
+
+	if inv.unsupported == nil {
+		inv.unsupported = make(map[string]bool)
+	}
+	failed := func(query, name string, err error) {
+		if c.nak {
+			log.Debugf("inverter with serialno '%s' does not support %s", inv.SerialNo, query)
+			inv.unsupported[query] = true
+			return
+		}
+		log.Debugf("failed to retrieve %s of inverter with serialno '%s': %s", name, inv.SerialNo, err)
+	}
+
+	if pi, err := axpert.ProtocolId(c); err != nil || c.nak {
+		failed("QPI", "protocol ID", err)
+	} else {
+		id.ProtocolID = pi
+	}
+
+	if fw, err := axpert.InverterFirmwareVersion(c); err == nil {
+		id.FirmwareMain = fw.Series + "." + fw.Version
+	} else {
+		failed("QVFW", "main CPU firmware version", err)
+	}
+
+	if fw, err := axpert.SCC1FirmwareVersion(c); err == nil {
+		id.FirmwareSecondary = fw.Series + "." + fw.Version
+	} else {
+		failed("QVFW2", "secondary CPU firmware version", err)
+	}
+
+	// Only recent firmware reports a model name, otherwise the model is derived from the ratings
+	mn, err := sendRequest(c, "QMN")
+	if err == nil && !c.nak {
+		id.Model = mn
+		return id
+	}
+	failed("QMN", "model name", err)
+
+	if ri, err := axpert.DeviceRatingInfo(c); err == nil {
+		id.Model = fmt.Sprintf("%dVA %gV", ri.ACOutputRatingApparentPower, ri.BatteryRatingVoltage)
+	} else {
+		failed("QPIRI", "model", err)
+	}
+
+	return id
+}
+
+// Opens a device and creates an inverter for it. The opener is kept so the device can be reopened
+// when its connector is dropped.
+func openInverter(open opener, device string, rec *Recorder) (*Inverter, error) {
+	cr, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	inv, err := newInverter(cr, device, rec)
+	if err != nil {
+		cr.Close()
+		return nil, err
+	}
+	inv.reopen = open
+
+	return inv, nil
+}
+
+// Opens the connector of a device
+type opener func() (connector.Connector, error)
+
+// Returns an opener for a USB HID device path
+func usbOpener(path string) opener {
+	return func() (connector.Connector, error) {
+		cr, err := connector.NewUSBConnector(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open USB device %s: %w", path, err)
+		}
+
+		return cr, nil
+	}
+}
+
+// Returns an opener for a serial device path
+func serialOpener(dev string) opener {
+	return func() (connector.Connector, error) {
+		cr := connector.NewSerialConnector(serialConfig(dev))
+		if err := cr.Open(); err != nil {
+			return nil, fmt.Errorf("failed to open serial device %s: %w", dev, err)
+		}
+
+		// The serial connector fails every read after a read timeout, so the port is reopened instead
+		return NewReopeningConnector(cr, dev), nil
+	}
+}
+
+// Returns an opener for a serial-to-TCP bridge address
+func tcpOpener(addr string) opener {
+	return func() (connector.Connector, error) {
+		cr := NewTCPConnector(addr, *tcpTimeout)
+		if err := cr.Open(); err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+		}
+
+		return cr, nil
+	}
+}
+
+// Returns the serial port configuration for a device path using the configured baud rate and parity
+func serialConfig(dev string) serial.Config {
+	return serial.Config{
+		Address:  dev,
+		BaudRate: *serialBaudRate,
+		DataBits: 8,
+		StopBits: 1,
+		Parity:   strings.ToUpper(*serialParity),
+		Timeout:  serialTimeout,
+	}
+}
+
+// Splits a comma-separated list and drops empty entries
+func splitList(s string) []string {
+	var items []string
+
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Takes an input and updates all current settings that the settings schema reads from it
 func (i *Inverter) UpdateCurrentSettings(input any) error {
 	if i.CurrentSettings == nil {
 		i.CurrentSettings = &CurrentSettings{}
 	}
 
-	switch inp := input.(type) {
-	case *axpert.ParallelInfo:
-		if cs := mapChargeSource(inp.ACCharging); cs != "" {
-			i.CurrentSettings.ChargeSource = cs
-		} else {
-			return fmt.Errorf("unrecognized charge source: %v", inp.ACCharging)
-		}
-	case *axpert.RatingInfo:
-		if osp := mapOutputSourcePriority(inp.OutputSourcePriority); osp != "" {
-			i.CurrentSettings.OutputSourcePriority = osp
-		} else {
-			return fmt.Errorf("unrecognized output source priority: %v", inp.OutputSourcePriority)
+	found := false
+	var errs []error
+	for _, s := range settingsSchema {
+		v, ok := s.read(input)
+		if !ok {
+			continue
 		}
+		found = true
 
-		if csp := mapChargerSourcePriority(inp.ChargerSourcePriority); csp != "" {
-			i.CurrentSettings.ChargerSourcePriority = csp
-		} else {
-			return fmt.Errorf("unrecognized charger source priority: %v", inp.ChargerSourcePriority)
+		// Enum values the gateway does not know are mapped to an empty string
+		if v == "" {
+			errs = append(errs, fmt.Errorf("unrecognized %s", s.Name))
+			continue
 		}
-
-		i.CurrentSettings.BatteryRechargeVoltage = inp.BatteryRechargeVoltage
-		i.CurrentSettings.BatteryRedischargeVoltage = inp.BatteryRedischargeVoltage
-		i.CurrentSettings.BatteryCutoffVoltage = inp.BatteryUnderVoltage
-		i.CurrentSettings.BatteryFloatVoltage = inp.BatteryFloatVoltage
-	case string:
-		if dMode := mapDeviceMode(inp); dMode != "" {
-			i.CurrentSettings.DeviceMode = dMode
-		} else {
-			return fmt.Errorf("unrecognized device mode: %s", inp)
+		if err := i.CurrentSettings.Set(s.Key, v); err != nil {
+			errs = append(errs, err)
 		}
-	default:
-		return fmt.Errorf("unknown input type: %T", inp)
 	}
 
-	return nil
+	if !found {
+		return fmt.Errorf("unknown input type: %T", input)
+	}
+
+	return errors.Join(errs...)
 }
 
 // Sets the output source priority to either 'utility', 'solar' or 'sbu'
 func setOutputSourcePriority(c connector.Connector, p string) error {
+	if err := validateSetting("outputSourcePriority", p, nil); err != nil {
+		return err
+	}
+
 	var osp axpert.OutputSourcePriority
 
 	switch p {
@@ -102,6 +322,10 @@ func setOutputSourcePriority(c connector.Connector, p string) error {
 
 // Sets the charger source priority to either 'utilityfirst', 'solarfirst', 'solarandutility' or 'solar only'
 func setChargerSourcePriority(c connector.Connector, p string) error {
+	if err := validateSetting("chargerSourcePriority", p, nil); err != nil {
+		return err
+	}
+
 	var csp axpert.ChargerSourcePriority
 
 	switch p {
@@ -125,17 +349,10 @@ func setChargerSourcePriority(c connector.Connector, p string) error {
 	return nil
 }
 
-// Sets the battery recharge voltage to a valid whole number (between 44 and 51 V).
+// Sets the battery recharge voltage, validated against the settings schema
 func setBatteryRechargeVoltage(c connector.Connector, cs *CurrentSettings, v float32) error {
-	switch {
-	case (v < 44 || v > 51) || !isWhole(v): // Invalid value
-		return fmt.Errorf("battery recharge voltage must be a whole number between 44 and 51 V")
-	case v > cs.BatteryRedischargeVoltage: // Exceeds the redischarge voltage
-		return fmt.Errorf("battery recharge voltage may not exceed redischarge voltage")
-	case v > cs.BatteryFloatVoltage: // Exceeds the float voltage
-		return fmt.Errorf("battery recharge voltage may not exceed float voltage")
-	case v < cs.BatteryCutoffVoltage: // Lower than cutoff voltage
-		return fmt.Errorf("battery recharge voltage may not be lower than cutoff voltage")
+	if err := validateSetting("batteryRechargeVoltage", v, cs); err != nil {
+		return err
 	}
 
 	if err := axpert.SetBatteryRechargeVoltage(c, v); err != nil {
@@ -145,17 +362,10 @@ func setBatteryRechargeVoltage(c connector.Connector, cs *CurrentSettings, v flo
 	return nil
 }
 
-// Sets the battery redischarge voltage to a valid whole number (between 48 and 58 V).
+// Sets the battery redischarge voltage, validated against the settings schema
 func setBatteryRedischargeVoltage(c connector.Connector, cs *CurrentSettings, v float32) error {
-	switch {
-	case (v < 48 || v > 58) || !isWhole(v): // Invalid value
-		return fmt.Errorf("battery redischarge voltage must be a whole number between 48 and 58 V")
-	case v < cs.BatteryRechargeVoltage: // Lower than redischarge voltage
-		return fmt.Errorf("battery redischarge voltage may not be lower than recharge voltage")
-	case v > cs.BatteryFloatVoltage: // Exceeds the float voltage
-		return fmt.Errorf("battery redischarge voltage may not exceed float voltage")
-	case v < cs.BatteryCutoffVoltage: // Lower than cutoff voltage
-		return fmt.Errorf("battery redischarge voltage may not be lower than cutoff voltage")
+	if err := validateSetting("batteryRedischargeVoltage", v, cs); err != nil {
+		return err
 	}
 
 	if err := axpert.SetBatteryRedischargeVoltage(c, v); err != nil {
@@ -165,20 +375,340 @@ func setBatteryRedischargeVoltage(c connector.Connector, cs *CurrentSettings, v
 	return nil
 }
 
-// Sets the maximum AC charge current.
-// TODO: Currently not working.
-// func setMaxACChargeCurrent(c connector.Connector, cr uint8) error {
-// 	// TODO: Add some kind of boundaries here
+// Sets the battery float voltage, validated against the settings schema
+func setBatteryFloatVoltage(c connector.Connector, cs *CurrentSettings, v float32) error {
+	if err := validateSetting("batteryFloatVoltage", v, cs); err != nil {
+		return err
+	}
 
-// 	err := axpert.SetMaxUtilityChargingCurrent(c, cr)
-// 	if err != nil {
-// 		return err
-// 	}
+	return axpert.SetFloatChargingVoltage(c, v)
+}
 
-// 	return nil
-// }
+// Sets the battery bulk (constant voltage) charging voltage, validated against the settings schema
+func setBatteryBulkVoltage(c connector.Connector, cs *CurrentSettings, v float32) error {
+	if err := validateSetting("batteryBulkVoltage", v, cs); err != nil {
+		return err
+	}
+
+	return axpert.SetCVModeChargingVoltage(c, v)
+}
+
+// Sets the battery cutoff voltage, validated against the settings schema
+func setBatteryCutoffVoltage(c connector.Connector, cs *CurrentSettings, v float32) error {
+	if err := validateSetting("batteryCutoffVoltage", v, cs); err != nil {
+		return err
+	}
+
+	return axpert.SetBatteryCutoffVoltage(c, v)
+}
+
+// Charging voltages the battery type profiles apply for 48 V units, by setting key, which are scaled
+// to the battery rating voltage of the inverter. Lithium profiles take their voltages from the
+// firmware or the BMS, so they are not known in advance. The user-defined profile keeps the current
+// voltages.
+var batteryProfiles = map[string]map[string]*float32{
+	"agm":     {"batteryBulkVoltage": ptr[float32](56.4), "batteryFloatVoltage": ptr[float32](54)},
+	"flooded": {"batteryBulkVoltage": ptr[float32](58.4), "batteryFloatVoltage": ptr[float32](54)},
+	"lithium": {"batteryBulkVoltage": nil, "batteryFloatVoltage": nil},
+	"user":    {},
+}
+
+// Returns a pointer to v
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// Represents a setting that is overridden by a command
+type SettingOverride struct {
+	Key     string `json:"key"`
+	Current any    `json:"current"`
+
+	// New value of the setting, null if it is determined by the inverter
+	New any `json:"new"`
+}
+
+// Returns the voltage settings that the profile of a battery type overrides. The voltages are scaled to
+// the battery rating voltage of the inverter, and unknown if the battery rating voltage is. They are
+// what the profile is expected to apply; the voltages the inverter applied are read back after the
+// battery type was changed (see reportedOverrides).
+func batteryTypeOverrides(cs *CurrentSettings, bt string) ([]SettingOverride, error) {
+	if err := validateSetting("batteryType", bt, nil); err != nil {
+		return nil, err
+	}
+	if cs == nil {
+		return nil, errNoCurrentSettings
+	}
+
+	overrides := make([]SettingOverride, 0)
+	for _, key := range slices.Sorted(maps.Keys(batteryProfiles[bt])) {
+		current, err := cs.Get(key)
+		if err != nil {
+			return nil, err
+		}
+
+		var v any
+		if pv := batteryProfiles[bt][key]; pv != nil && cs.BatteryRatingVoltage > 0 {
+			v = float32(scaleVoltage(float64(*pv), float64(cs.BatteryRatingVoltage)/48))
+		}
+		if v == current {
+			continue
+		}
+
+		overrides = append(overrides, SettingOverride{Key: key, Current: current, New: v})
+	}
+
+	return overrides, nil
+}
+
+// Replaces the new values of the overridden settings by the values the inverter reports after the
+// battery type was changed and read back
+func (a *Application) reportedOverrides(serialNo string, overrides []SettingOverride) []SettingOverride {
+	inv, err := findInverterBySerial(a, serialNo)
+	if err != nil {
+		return overrides
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if inv.CurrentSettings == nil {
+		return overrides
+	}
+
+	reported := make([]SettingOverride, 0, len(overrides))
+	for _, o := range overrides {
+		if v, err := inv.CurrentSettings.Get(o.Key); err == nil {
+			o.New = v
+		}
+		reported = append(reported, o)
+	}
+
+	return reported
+}
+
+// Sets the battery type to either 'agm', 'flooded', 'user' or 'lithium'
+func setBatteryType(c connector.Connector, bt string) error {
+	if err := validateSetting("batteryType", bt, nil); err != nil {
+		return err
+	}
+
+	var t axpert.BatteryType
+
+	switch bt {
+	case "agm":
+		t = axpert.AGM
+	case "flooded":
+		t = axpert.Flooded
+	case "user":
+		t = axpert.User
+	case "lithium":
+		t = batteryLithium
+	default:
+		return fmt.Errorf("unrecognized battery type: %s", bt)
+	}
+
+	return axpert.SetBatteryType(c, t)
+}
+
+// Parses a list of allowed charge currents as reported by QMUCHGCR or QMCHGCR
+func parseCurrents(resp string) ([]int, error) {
+	if resp == "NAK" {
+		return nil, errNotSupported
+	}
+
+	var currents []int
+	for _, f := range strings.Fields(resp) {
+		cr, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid charge current list: %s", resp)
+		}
+		currents = append(currents, cr)
+	}
+
+	if len(currents) == 0 {
+		return nil, fmt.Errorf("empty charge current list")
+	}
+
+	return currents, nil
+}
+
+// Returns the maximum utility (AC) charge currents the inverter allows (QMUCHGCR)
+func allowedUtilityChargeCurrents(c connector.Connector) ([]int, error) {
+	resp, err := axpert.MaxUtilityChargingCurrent(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve allowed utility charge currents: %w", err)
+	}
+
+	allowed, err := parseCurrents(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve allowed utility charge currents: %w", err)
+	}
+
+	return allowed, nil
+}
+
+// Returns the maximum total charge currents the inverter allows (QMCHGCR)
+func allowedChargeCurrents(c connector.Connector) ([]int, error) {
+	resp, err := axpert.MaxTotalChargingCurrent(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve allowed charge currents: %w", err)
+	}
+
+	allowed, err := parseCurrents(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve allowed charge currents: %w", err)
+	}
+
+	return allowed, nil
+}
+
+// Functions returning the values the inverter allows for a setting, by setting key, for settings that
+// only allow some of the values in their range
+var allowedValues = map[string]func(c connector.Connector, cs *CurrentSettings) ([]int, error){
+	"maxACChargeCurrent": func(c connector.Connector, cs *CurrentSettings) ([]int, error) {
+		return allowedUtilityChargeCurrents(c)
+	},
+	"maxChargeCurrent": func(c connector.Connector, cs *CurrentSettings) ([]int, error) {
+		return allowedChargeCurrents(c)
+	},
+	"outputRatingVoltage": func(c connector.Connector, cs *CurrentSettings) ([]int, error) {
+		return allowedOutputVoltages(cs)
+	},
+}
+
+// Returns an error listing the allowed values if v is not one of them
+func checkAllowed(name string, v int, allowed []int, unit string) error {
+	if slices.Contains(allowed, v) {
+		return nil
+	}
+
+	values := make([]string, 0, len(allowed))
+	for _, a := range allowed {
+		values = append(values, strconv.Itoa(a))
+	}
+
+	return &ValidationError{Err: fmt.Errorf("%s must be one of %s %s", name, strings.Join(values, ", "), unit)}
+}
+
+// Validates a value for a setting against the settings schema and the values the inverter allows
+func validateAllowed(c connector.Connector, cs *CurrentSettings, key string, v float64) error {
+	if err := validateSetting(key, v, cs); err != nil {
+		return err
+	}
+
+	allowed, err := allowedValues[key](c, cs)
+	if err != nil {
+		return err
+	}
+
+	s, _ := findSetting(key)
+	return checkAllowed(s.Name, int(v), allowed, s.Unit)
+}
+
+// Sets the maximum utility (AC) charge current to one of the values the inverter allows (QMUCHGCR),
+// validated against the settings schema
+func setMaxUtilityChargeCurrent(c connector.Connector, cs *CurrentSettings, cr float64) error {
+	if err := validateAllowed(c, cs, "maxACChargeCurrent", cr); err != nil {
+		return err
+	}
+
+	return axpert.SetMaxUtilityChargingCurrent(c, uint8(cr))
+}
+
+// Sets the maximum total (solar and utility) charge current of the unit with the given parallel index
+// to one of the values the inverter allows (QMCHGCR), validated against the settings schema
+func setMaxChargeCurrent(c connector.Connector, cs *CurrentSettings, cr float64, parallelID int) error {
+	if parallelID < 0 || parallelID > maxParallelIndex {
+		return &ValidationError{Err: fmt.Errorf("parallel id must be between 0 and %d", maxParallelIndex)}
+	}
+
+	if err := validateAllowed(c, cs, "maxChargeCurrent", cr); err != nil {
+		return err
+	}
+
+	return axpert.SetMaxTotalChargingCurrent(c, uint8(cr), uint8(parallelID))
+}
+
+// Represents a voltage class of inverters by the range of their grid rating voltage, and the output
+// voltages inverters of the class can be set to
+type voltageClass struct {
+	GridMin, GridMax float32
+	Output           []int
+}
+
+// Voltage classes of inverters. The protocol does not report the output voltages an inverter allows,
+// so they are inferred from its class.
+var voltageClasses = []voltageClass{
+	{GridMin: 200, GridMax: 250, Output: []int{220, 230, 240}},
+	{GridMin: 100, GridMax: 140, Output: []int{110, 120, 127}},
+}
+
+// Returns the output voltages the inverter allows, inferred from the voltage class of its grid rating
+// voltage (QPIRI). The current output rating voltage and frequency must be consistent with the class,
+// so values are not inferred from rating information that was not read correctly.
+func allowedOutputVoltages(cs *CurrentSettings) ([]int, error) {
+	if cs == nil {
+		return nil, errNoCurrentSettings
+	}
+
+	i := slices.IndexFunc(voltageClasses, func(vc voltageClass) bool {
+		return cs.GridRatingVoltage >= vc.GridMin && cs.GridRatingVoltage <= vc.GridMax
+	})
+	if i < 0 {
+		return nil, fmt.Errorf("allowed output voltages are unknown for a grid rating voltage of %g V", cs.GridRatingVoltage)
+	}
+	vc := voltageClasses[i]
+
+	if !slices.Contains(vc.Output, int(cs.OutputRatingVoltage)) {
+		return nil, fmt.Errorf("output rating voltage of %g V does not match the grid rating voltage of %g V", cs.OutputRatingVoltage, cs.GridRatingVoltage)
+	}
+	if cs.OutputRatingFrequency != 50 && cs.OutputRatingFrequency != 60 {
+		return nil, fmt.Errorf("output rating frequency of %g Hz does not match the grid rating voltage of %g V", cs.OutputRatingFrequency, cs.GridRatingVoltage)
+	}
+
+	return vc.Output, nil
+}
+
+// Sets the output voltage to one of the values of the voltage class of the inverter. The inverter
+// must be in standby mode.
+func setOutputVoltage(c connector.Connector, cs *CurrentSettings, v int) error {
+	if err := validateAllowed(c, cs, "outputRatingVoltage", float64(v)); err != nil {
+		return err
+	}
+
+	return sendCommand(c, fmt.Sprintf("V%03d", v))
+}
+
+// Sets the output frequency to either 50 or 60 Hz. The inverter must be in standby mode.
+func setOutputFrequency(c connector.Connector, cs *CurrentSettings, f int) error {
+	if err := validateSetting("outputRatingFrequency", f, cs); err != nil {
+		return err
+	}
+
+	return axpert.SetOutputRatingFrequency(c, uint8(f))
+}
+
+// Enables or disables a device flag. Flags the inverter did not report in its device flag status are
+// refused.
+func setFlag(c connector.Connector, cs *CurrentSettings, name string, on bool) error {
+	if err := validateSetting("flags", map[string]bool{name: on}, cs); err != nil {
+		return err
+	}
+
+	if cs != nil && cs.Flags != nil {
+		if _, ok := cs.Flags[name]; !ok {
+			return &ValidationError{Err: fmt.Errorf("device flag %s is not supported by the inverter", name)}
+		}
+	}
+
+	df, err := findDeviceFlag(name)
+	if err != nil {
+		return err
+	}
+
+	if on {
+		return axpert.EnableDeviceFlags(c, []axpert.DeviceFlag{df.Flag})
+	}
 
-// Returns true if f is a whole number.
-func isWhole(f float32) bool {
-	return f == float32(int(f))
+	return axpert.DisableDeviceFlags(c, []axpert.DeviceFlag{df.Flag})
 }
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Statuses of the settings of a batch
+const (
+	batchApplied        = "applied"
+	batchUnchanged      = "unchanged"
+	batchInvalid        = "invalid"
+	batchFailed         = "failed"
+	batchSkipped        = "skipped"
+	batchRolledBack     = "rolledback"
+	batchRollbackFailed = "rollbackfailed"
+)
+
+// Represents the result of a single setting of a batch
+type SettingResult struct {
+	Key      string `json:"key"`
+	Value    any    `json:"value"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+	ReadBack any    `json:"readback,omitempty"`
+}
+
+// Represents the JSON response for batch settings requests
+type ApplySettingsResponse struct {
+	SerialNo string           `json:"serialno"`
+	Status   string           `json:"status"`
+	Message  string           `json:"message"`
+	Results  []*SettingResult `json:"results"`
+}
+
+// Represents a change of a single setting of a batch
+type settingChange struct {
+	Setting *Setting
+
+	// Key of the change in the results, flags.<name> for device flags
+	Key  string
+	Flag string
+
+	// Requested value and the value before the batch was applied
+	Value   any
+	Current any
+
+	// Values the inverter allows, nil if any value the settings schema allows is accepted
+	Allowed []int
+}
+
+// Returns the command request setting the changed setting to v
+func (ch settingChange) request(serialNo string, v any) CommandRequest {
+	return CommandRequest{Value: commandValue(v), SerialNo: serialNo, Flag: ch.Flag}
+}
+
+// Returns the value of a command request for a setting value
+func commandValue(v any) string {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return "on"
+		}
+		return "off"
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Returns the change that undoes the change
+func (ch settingChange) reverted() settingChange {
+	ch.Value, ch.Current = ch.Current, ch.Value
+	return ch
+}
+
+// Validates changing the setting to v against the given settings
+func (ch settingChange) validate(cs *CurrentSettings, v any) error {
+	if ch.Setting.Type != settingFlags {
+		if err := ch.Setting.Validate(v, cs); err != nil {
+			return err
+		}
+		if ch.Allowed == nil {
+			return nil
+		}
+
+		f, _ := toNumber(reflect.ValueOf(v))
+		return checkAllowed(ch.Setting.Name, int(f), ch.Allowed, ch.Setting.Unit)
+	}
+
+	on, _ := v.(bool)
+	if err := ch.Setting.Validate(map[string]bool{ch.Flag: on}, cs); err != nil {
+		return err
+	}
+	if _, ok := cs.Flags[ch.Flag]; !ok {
+		return fmt.Errorf("device flag %s is not supported by the inverter", ch.Flag)
+	}
+
+	return nil
+}
+
+// Changes the setting to v in the given settings. Battery types also change the voltages their
+// profile overrides.
+func (ch settingChange) set(cs *CurrentSettings, v any) error {
+	if ch.Setting.Type == settingFlags {
+		if _, ok := cs.Flags[ch.Flag]; !ok {
+			return fmt.Errorf("device flag %s is not supported by the inverter", ch.Flag)
+		}
+		cs.Flags[ch.Flag], _ = v.(bool)
+		return nil
+	}
+
+	if ch.Setting.Key == "batteryType" {
+		overrides, err := batteryTypeOverrides(cs, fmt.Sprint(v))
+		if err != nil {
+			return err
+		}
+		for _, o := range overrides {
+			if o.New == nil {
+				continue
+			}
+			if err := cs.Set(o.Key, o.New); err != nil {
+				return err
+			}
+		}
+	}
+
+	return cs.Set(ch.Setting.Key, v)
+}
+
+// Parses a partial current settings document into changes, in the order of the settings schema with
+// the battery type first, as its profile overrides other settings. Settings that cannot be changed
+// are returned as invalid results.
+func parseSettingChanges(doc map[string]json.RawMessage, cs *CurrentSettings) ([]settingChange, []*SettingResult) {
+	var changes []settingChange
+	var invalid []*SettingResult
+
+	for _, key := range slices.Sorted(maps.Keys(doc)) {
+		if _, err := findSetting(key); err != nil {
+			invalid = append(invalid, &SettingResult{Key: key, Value: doc[key], Status: batchInvalid, Message: err.Error()})
+		}
+	}
+
+	order := append([]string{"batteryType"}, names(settingsSchema, func(s Setting) string { return s.Key })...)
+	seen := make(map[string]bool)
+	for _, key := range order {
+		raw, ok := doc[key]
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		s, _ := findSetting(key)
+		if s.Command == "" {
+			invalid = append(invalid, &SettingResult{Key: key, Value: raw, Status: batchInvalid, Message: s.Name + " cannot be changed"})
+			continue
+		}
+
+		switch s.Type {
+		case settingFlags:
+			var flags map[string]bool
+			if err := json.Unmarshal(raw, &flags); err != nil {
+				invalid = append(invalid, &SettingResult{Key: key, Value: raw, Status: batchInvalid, Message: s.Name + " must be a set of flags"})
+				continue
+			}
+			for _, df := range deviceFlags {
+				if on, ok := flags[df.Name]; ok {
+					changes = append(changes, settingChange{Setting: s, Key: key + "." + df.Name, Flag: df.Name, Value: on, Current: cs.Flags[df.Name]})
+					delete(flags, df.Name)
+				}
+			}
+			for name, on := range flags {
+				invalid = append(invalid, &SettingResult{Key: key + "." + name, Value: on, Status: batchInvalid, Message: "unknown device flag: " + name})
+			}
+		case settingEnum:
+			var v string
+			if err := json.Unmarshal(raw, &v); err != nil {
+				invalid = append(invalid, &SettingResult{Key: key, Value: raw, Status: batchInvalid, Message: s.Name + " must be a string"})
+				continue
+			}
+			current, _ := cs.Get(key)
+			changes = append(changes, settingChange{Setting: s, Key: key, Value: v, Current: current})
+		default:
+			var v float64
+			if err := json.Unmarshal(raw, &v); err != nil {
+				invalid = append(invalid, &SettingResult{Key: key, Value: raw, Status: batchInvalid, Message: s.Name + " must be a number"})
+				continue
+			}
+			current, _ := cs.Get(key)
+			changes = append(changes, settingChange{Setting: s, Key: key, Value: v, Current: current})
+		}
+	}
+
+	return changes, invalid
+}
+
+// Returns an order in which the changes can be applied one at a time, so that the settings are valid
+// after every step. Changes are taken in their given order where possible.
+func orderChanges(changes []settingChange, cs *CurrentSettings) ([]settingChange, error) {
+	state := cs.clone()
+	pending := append([]settingChange(nil), changes...)
+	ordered := make([]settingChange, 0, len(changes))
+
+	for len(pending) > 0 {
+		next := -1
+		for i, ch := range pending {
+			if ch.validate(state, ch.Value) == nil {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, fmt.Errorf("%s cannot be applied one at a time without violating the other settings", pending[0].Key)
+		}
+
+		if err := pending[next].set(state, pending[next].Value); err != nil {
+			return nil, err
+		}
+		ordered = append(ordered, pending[next])
+		pending = append(pending[:next], pending[next+1:]...)
+	}
+
+	return ordered, nil
+}
+
+// Refreshes what the requested settings are validated against before any of them is changed: the
+// device mode, if a requested setting requires one, and the values the inverter allows for the
+// requested settings. Returns a snapshot of the current settings, nil if they are not available yet,
+// and the allowed values by setting key.
+func (a *Application) refreshBatchSettings(inv *Inverter, doc map[string]json.RawMessage) (*CurrentSettings, map[string][]int, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if inv.CurrentSettings == nil {
+		return nil, nil, nil
+	}
+
+	var keys []string
+	needsMode := false
+	for key := range doc {
+		s, err := findSetting(key)
+		if err != nil || s.Command == "" {
+			continue
+		}
+		if _, ok := s.Requires["deviceMode"]; ok {
+			needsMode = true
+		}
+		if _, ok := allowedValues[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+
+	allowed := make(map[string][]int, len(keys))
+	if needsMode || len(keys) > 0 {
+		c, err := a.conn(inv)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if needsMode {
+			if err := refreshDeviceMode(inv, c); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		for _, key := range keys {
+			values, err := allowedValues[key](c, inv.CurrentSettings)
+			if err != nil {
+				return nil, nil, err
+			}
+			allowed[key] = values
+		}
+	}
+
+	return inv.CurrentSettings.clone(), allowed, nil
+}
+
+// Applies a single change with its command handler and reads the setting back. Returns whether the
+// inverter acknowledged the command, which means it may have changed the setting even on error.
+func (a *Application) applyChange(serialNo string, ch settingChange, v any) (any, bool, error) {
+	req := ch.request(serialNo, v)
+
+	handler, ok := commandHandlers[ch.Setting.Command]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown command: %s", ch.Setting.Command)
+	}
+	if err := handler(a, req); err != nil {
+		return nil, false, err
+	}
+
+	readBack, err := a.readBack(ch.Setting, req)
+	if err != nil {
+		return nil, true, fmt.Errorf("command acknowledged, but %s could not be read back: %w", ch.Setting.Name, err)
+	}
+	if !matchesRequest(ch.Setting, req, readBack) {
+		return readBack, true, fmt.Errorf("command acknowledged, but the inverter reports %v", readBack)
+	}
+
+	return readBack, true, nil
+}
+
+// Handles applying several settings at once. The settings are validated against each other before
+// any of them is changed, and settings that were already applied are rolled back if one fails.
+func (a *Application) handleApplySettings(w http.ResponseWriter, r *http.Request) {
+	serialNo := httprouter.ParamsFromContext(r.Context()).ByName("serial")
+
+	if !*controlEnabled {
+		http.Error(w, "Control API is disabled", http.StatusForbidden)
+		return
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		log.Errorf("Failed to decode request body: %v", err)
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	log.Infof("Applying %d settings for inverter with serialno '%s'", len(doc), serialNo)
+
+	inv, err := findInverterBySerial(a, serialNo)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Batches for the same inverter are serialized, so their validation, changes and rollbacks do not interleave
+	inv.batch.Lock()
+	defer inv.batch.Unlock()
+
+	snapshot, allowed, err := a.refreshBatchSettings(inv, doc)
+	if err != nil {
+		log.Errorf("Failed to refresh settings of %s: %v", serialNo, err)
+		a.writeApplySettingsResponse(w, http.StatusInternalServerError, ApplySettingsResponse{
+			SerialNo: serialNo,
+			Status:   "error",
+			Message:  err.Error(),
+		})
+		return
+	}
+	if snapshot == nil {
+		log.Errorf("Current settings not available for %s (may not have been collected yet)", serialNo)
+		http.Error(w, errNoCurrentSettings.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	response := ApplySettingsResponse{SerialNo: serialNo}
+	changes, invalid := parseSettingChanges(doc, snapshot)
+	for i := range changes {
+		changes[i].Allowed = allowed[changes[i].Key]
+	}
+
+	// Settings that already have the requested value are left alone
+	results := make(map[string]*SettingResult, len(changes))
+	var pending []settingChange
+	for _, ch := range changes {
+		res := &SettingResult{Key: ch.Key, Value: ch.Value, Status: batchSkipped}
+		results[ch.Key] = res
+		response.Results = append(response.Results, res)
+
+		if matchesRequest(ch.Setting, ch.request(serialNo, ch.Value), ch.Current) {
+			res.Status = batchUnchanged
+			continue
+		}
+		pending = append(pending, ch)
+	}
+	response.Results = append(response.Results, invalid...)
+
+	// Validate the merged settings, so settings are checked against the other settings of the batch
+	merged := snapshot.clone()
+	for _, ch := range pending {
+		if err := ch.set(merged, ch.Value); err != nil {
+			results[ch.Key].Status = batchInvalid
+			results[ch.Key].Message = err.Error()
+		}
+	}
+	for _, ch := range pending {
+		if err := ch.validate(merged, ch.Value); err != nil && results[ch.Key].Status != batchInvalid {
+			results[ch.Key].Status = batchInvalid
+			results[ch.Key].Message = err.Error()
+		}
+	}
+
+	ordered, err := orderChanges(pending, snapshot)
+	if err != nil {
+		response.Message = err.Error()
+	}
+
+	for _, res := range response.Results {
+		if res.Status == batchInvalid {
+			response.Message = "Settings are invalid, nothing was changed"
+			break
+		}
+	}
+	if response.Message != "" {
+		response.Status = "error"
+		a.writeApplySettingsResponse(w, http.StatusBadRequest, response)
+		return
+	}
+
+	// Changes that were acknowledged, in the order they were applied, and the voltages a battery type
+	// profile overrode by the key of the battery type change
+	var applied []settingChange
+	overridden := make(map[string][]settingChange)
+	var failure error
+
+	for _, ch := range ordered {
+		var overrides []SettingOverride
+		if ch.Setting.Key == "batteryType" && ch.Current == "user" {
+			inv.mu.Lock()
+			overrides, _ = batteryTypeOverrides(inv.CurrentSettings, fmt.Sprint(ch.Value))
+			inv.mu.Unlock()
+		}
+
+		readBack, acknowledged, err := a.applyChange(serialNo, ch, ch.Value)
+		res := results[ch.Key]
+		res.ReadBack = readBack
+
+		if acknowledged {
+			// The rollback starts from the voltages the profile applied, as far as they were read back
+			if readBack != nil {
+				overrides = a.reportedOverrides(serialNo, overrides)
+			}
+
+			var restores []settingChange
+			for _, o := range overrides {
+				s, _ := findSetting(o.Key)
+				restores = append(restores, settingChange{Setting: s, Key: o.Key, Value: o.New, Current: o.Current})
+			}
+
+			applied = append(applied, ch)
+			overridden[ch.Key] = restores
+		}
+		if err != nil {
+			log.Errorf("Failed to apply %s: %v", ch.Key, err)
+			res.Status = batchFailed
+			res.Message = err.Error()
+			failure = fmt.Errorf("%s: %w", ch.Key, err)
+			break
+		}
+
+		res.Status = batchApplied
+	}
+
+	if failure == nil {
+		response.Status = "success"
+		response.Message = "Settings applied successfully"
+		a.writeApplySettingsResponse(w, http.StatusOK, response)
+		return
+	}
+
+	// Roll back in reverse order, which passes through the same valid settings. The voltages a battery
+	// type profile overrode are not part of that order, so they are restored in an order that is valid
+	// for the settings after the battery type was rolled back.
+	var rollbackErrs []error
+	for i := len(applied) - 1; i >= 0; i-- {
+		ch := applied[i]
+		if err := a.rollBackChange(serialNo, ch, results, &response); err != nil {
+			rollbackErrs = append(rollbackErrs, err)
+		}
+
+		restores := overridden[ch.Key]
+		if len(restores) == 0 {
+			continue
+		}
+
+		reverted := make([]settingChange, 0, len(restores))
+		for _, r := range restores {
+			reverted = append(reverted, r.reverted())
+		}
+
+		inv.mu.Lock()
+		var cs *CurrentSettings
+		if inv.CurrentSettings != nil {
+			cs = inv.CurrentSettings.clone()
+		}
+		inv.mu.Unlock()
+
+		var order []settingChange
+		err := errNoCurrentSettings
+		if cs != nil {
+			order, err = orderChanges(reverted, cs)
+		}
+		if err != nil {
+			for _, r := range restores {
+				res := a.rollbackResult(r, results, &response)
+				res.Status = batchRollbackFailed
+				res.Message = err.Error()
+			}
+			log.Errorf("Failed to roll back the voltages overridden by %s: %v", ch.Key, err)
+			rollbackErrs = append(rollbackErrs, err)
+			continue
+		}
+
+		for _, r := range order {
+			if err := a.rollBackChange(serialNo, r.reverted(), results, &response); err != nil {
+				rollbackErrs = append(rollbackErrs, err)
+			}
+		}
+	}
+
+	response.Status = "error"
+	response.Message = fmt.Sprintf("Failed to apply %v, applied settings were rolled back", failure)
+	if len(rollbackErrs) > 0 {
+		response.Message = fmt.Sprintf("Failed to apply %v, rolling back failed: %v", failure, errors.Join(rollbackErrs...))
+	}
+	a.writeApplySettingsResponse(w, http.StatusInternalServerError, response)
+}
+
+// Returns the result of a change that is rolled back, adding one to the response for voltages that
+// were overridden by a battery type profile
+func (a *Application) rollbackResult(ch settingChange, results map[string]*SettingResult, response *ApplySettingsResponse) *SettingResult {
+	res, ok := results[ch.Key]
+	if !ok {
+		res = &SettingResult{Key: ch.Key, Value: ch.Value}
+		results[ch.Key] = res
+		response.Results = append(response.Results, res)
+	}
+
+	return res
+}
+
+// Rolls a change back to the value before the batch and records the outcome in its result
+func (a *Application) rollBackChange(serialNo string, ch settingChange, results map[string]*SettingResult, response *ApplySettingsResponse) error {
+	res := a.rollbackResult(ch, results, response)
+
+	readBack, _, err := a.applyChange(serialNo, ch, ch.Current)
+	res.ReadBack = readBack
+	if err != nil {
+		log.Errorf("Failed to roll back %s: %v", ch.Key, err)
+		res.Status = batchRollbackFailed
+		res.Message = err.Error()
+		return err
+	}
+
+	if res.Status != batchFailed {
+		res.Status = batchRolledBack
+	}
+
+	return nil
+}
+
+// Writes the response of a batch settings request
+func (a *Application) writeApplySettingsResponse(w http.ResponseWriter, status int, response ApplySettingsResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Failed to encode apply settings response: %v", err)
+	}
+}
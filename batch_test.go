@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marevers/energia/pkg/axpert"
+)
+
+// Returns the keys of the changes in their order
+func changeKeys(changes []settingChange) []string {
+	return names(changes, func(ch settingChange) string { return ch.Key })
+}
+
+// Returns a change of the setting with the given key
+func testChange(t *testing.T, key string, v any) settingChange {
+	t.Helper()
+
+	s, err := findSetting(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return settingChange{Setting: s, Key: key, Value: v}
+}
+
+func TestParseSettingChanges(t *testing.T) {
+	doc := map[string]json.RawMessage{
+		"outputSourcePriority":   json.RawMessage(`"utility"`),
+		"batteryFloatVoltage":    json.RawMessage(`55.2`),
+		"batteryType":            json.RawMessage(`"agm"`),
+		"flags":                  json.RawMessage(`{"backlight": false, "buzzer": true, "turbo": true}`),
+		"gridRatingVoltage":      json.RawMessage(`230`),
+		"batteryRechargeVoltage": json.RawMessage(`"48"`),
+		"chargerSourcePriority":  json.RawMessage(`2`),
+		"turbo":                  json.RawMessage(`true`),
+	}
+
+	changes, invalid := parseSettingChanges(doc, testSettings())
+
+	// The battery type comes first, the other settings and flags in the order of the schema
+	want := []string{"batteryType", "outputSourcePriority", "batteryFloatVoltage", "flags.buzzer", "flags.backlight"}
+	if got := changeKeys(changes); !slices.Equal(got, want) {
+		t.Errorf("got changes %v, want %v", got, want)
+	}
+
+	float := changes[slices.IndexFunc(changes, func(ch settingChange) bool { return ch.Key == "batteryFloatVoltage" })]
+	if float.Value != 55.2 || float.Current != float32(54) {
+		t.Errorf("got float voltage change from %v to %v, want from 54 to 55.2", float.Current, float.Value)
+	}
+	buzzer := changes[slices.IndexFunc(changes, func(ch settingChange) bool { return ch.Key == "flags.buzzer" })]
+	if buzzer.Flag != "buzzer" || buzzer.Value != true || buzzer.Current != true {
+		t.Errorf("got buzzer change %+v", buzzer)
+	}
+
+	wantInvalid := map[string]string{
+		"turbo":                  "unknown setting: turbo",
+		"gridRatingVoltage":      "grid rating voltage cannot be changed",
+		"batteryRechargeVoltage": "battery recharge voltage must be a number",
+		"chargerSourcePriority":  "charger source priority must be a string",
+		"flags.turbo":            "unknown device flag: turbo",
+	}
+	if len(invalid) != len(wantInvalid) {
+		t.Errorf("got %d invalid settings, want %d", len(invalid), len(wantInvalid))
+	}
+	for _, res := range invalid {
+		if res.Status != batchInvalid || res.Message != wantInvalid[res.Key] {
+			t.Errorf("%s: got %s %q, want invalid %q", res.Key, res.Status, res.Message, wantInvalid[res.Key])
+		}
+	}
+}
+
+func TestOrderChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(cs *CurrentSettings)
+		changes map[string]any
+		order   []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "schema order",
+			changes: map[string]any{"outputSourcePriority": "utility", "batteryRechargeVoltage": 45.0},
+			order:   []string{"outputSourcePriority", "batteryRechargeVoltage"},
+			want:    []string{"outputSourcePriority", "batteryRechargeVoltage"},
+		},
+		{
+			// The recharge voltage may not exceed the redischarge and float voltages, and the
+			// redischarge voltage may not exceed the float voltage
+			name: "raise float before recharge",
+			modify: func(cs *CurrentSettings) {
+				cs.BatteryRedischargeVoltage = 48
+				cs.BatteryFloatVoltage = 48
+			},
+			changes: map[string]any{"batteryRechargeVoltage": 50.0, "batteryRedischargeVoltage": 52.0, "batteryFloatVoltage": 52.0},
+			order:   []string{"batteryRechargeVoltage", "batteryRedischargeVoltage", "batteryFloatVoltage"},
+			want:    []string{"batteryFloatVoltage", "batteryRedischargeVoltage", "batteryRechargeVoltage"},
+		},
+		{
+			name:    "lower bulk after float",
+			changes: map[string]any{"batteryBulkVoltage": 53.0, "batteryFloatVoltage": 52.0, "batteryRedischargeVoltage": 50.0},
+			order:   []string{"batteryRedischargeVoltage", "batteryFloatVoltage", "batteryBulkVoltage"},
+			want:    []string{"batteryRedischargeVoltage", "batteryFloatVoltage", "batteryBulkVoltage"},
+		},
+		{
+			name:    "no valid order",
+			changes: map[string]any{"batteryFloatVoltage": 57.0},
+			order:   []string{"batteryFloatVoltage"},
+			wantErr: "batteryFloatVoltage cannot be applied one at a time",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := testSettings()
+			if tt.modify != nil {
+				tt.modify(cs)
+			}
+
+			var changes []settingChange
+			for _, key := range tt.order {
+				changes = append(changes, testChange(t, key, tt.changes[key]))
+			}
+
+			ordered, err := orderChanges(changes, cs)
+			checkErr(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+
+			if got := changeKeys(ordered); !slices.Equal(got, tt.want) {
+				t.Errorf("got order %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Returns an application with a single simulated inverter whose settings were collected
+func newTestApplication(t *testing.T, modify func(sc *SimulatedConnector)) (*Application, *Inverter, *SimulatedConnector) {
+	t.Helper()
+
+	enabled := *controlEnabled
+	*controlEnabled = true
+	t.Cleanup(func() { *controlEnabled = enabled })
+
+	sc := NewSimulatedConnector(0)
+	if modify != nil {
+		modify(sc)
+	}
+
+	inv, err := newInverter(sc, "sim0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Application{
+		Prometheus: &Prometheus{Reg: createRegistry()},
+		Inverters:  []*Inverter{inv},
+	}
+	app.Prometheus.RegisterMetrics()
+
+	var groups []queryGroup
+	for _, g := range queryGroups {
+		if g.Name == "rating" || g.Name == "mode" || g.Name == "flags" {
+			groups = append(groups, g)
+		}
+	}
+	app.CalculateMetrics(inv, groups)
+	if inv.CurrentSettings == nil {
+		t.Fatal("settings of the simulated inverter were not collected")
+	}
+
+	return app, inv, sc
+}
+
+// Applies a batch of settings to the simulated inverter and returns the status code and response
+func applySettings(t *testing.T, app *Application, body string) (int, ApplySettingsResponse) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/inverters/90000000000001/settings", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	app.Routes().ServeHTTP(w, r)
+
+	var response ApplySettingsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	return w.Code, response
+}
+
+// Fails the test if the results of a batch do not have the given statuses
+func checkResults(t *testing.T, response ApplySettingsResponse, want map[string]string) {
+	t.Helper()
+
+	got := make(map[string]string, len(response.Results))
+	for _, res := range response.Results {
+		got[res.Key] = res.Status
+	}
+
+	for key, status := range want {
+		if got[key] != status {
+			t.Errorf("%s: got status %q, want %q", key, got[key], status)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got results %v, want %v", got, want)
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	app, _, sc := newTestApplication(t, nil)
+
+	code, response := applySettings(t, app, `{"outputSourcePriority": "utility", "batteryRechargeVoltage": 48, "batteryRedischargeVoltage": 54, "maxACChargeCurrent": 20, "flags": {"buzzer": false}}`)
+	if code != http.StatusOK {
+		t.Fatalf("got status code %d: %s", code, response.Message)
+	}
+
+	checkResults(t, response, map[string]string{
+		"outputSourcePriority":      batchApplied,
+		"batteryRechargeVoltage":    batchApplied,
+		"batteryRedischargeVoltage": batchUnchanged,
+		"maxACChargeCurrent":        batchApplied,
+		"flags.buzzer":              batchApplied,
+	})
+
+	if sc.outputSourcePriority != axpert.OutputUtilityFirst || sc.batteryRechargeVoltage != 48 || sc.maxACChargingCurrent != 20 || sc.flags[axpert.Buzzer] {
+		t.Errorf("settings were not applied to the inverter: %+v", sc)
+	}
+}
+
+func TestApplySettingsReordered(t *testing.T) {
+	app, _, sc := newTestApplication(t, func(sc *SimulatedConnector) {
+		sc.batteryRedischargeVoltage = 48
+		sc.batteryFloatVoltage = 48
+	})
+
+	code, response := applySettings(t, app, `{"batteryRechargeVoltage": 50, "batteryRedischargeVoltage": 52, "batteryFloatVoltage": 52}`)
+	if code != http.StatusOK {
+		t.Fatalf("got status code %d: %s", code, response.Message)
+	}
+
+	if sc.batteryRechargeVoltage != 50 || sc.batteryRedischargeVoltage != 52 || sc.batteryFloatVoltage != 52 {
+		t.Errorf("got recharge %g, redischarge %g and float voltage %g, want 50, 52 and 52",
+			sc.batteryRechargeVoltage, sc.batteryRedischargeVoltage, sc.batteryFloatVoltage)
+	}
+}
+
+func TestApplySettingsValidatesBeforeApplying(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want map[string]string
+	}{
+		{
+			name: "value the inverter does not allow",
+			body: `{"outputSourcePriority": "utility", "maxACChargeCurrent": 25}`,
+			want: map[string]string{"outputSourcePriority": batchSkipped, "maxACChargeCurrent": batchInvalid},
+		},
+		{
+			name: "fractional current",
+			body: `{"outputSourcePriority": "utility", "maxChargeCurrent": 30.5}`,
+			want: map[string]string{"outputSourcePriority": batchSkipped, "maxChargeCurrent": batchInvalid},
+		},
+		{
+			name: "output voltage outside standby mode",
+			body: `{"outputSourcePriority": "utility", "outputRatingVoltage": 220}`,
+			want: map[string]string{"outputSourcePriority": batchSkipped, "outputRatingVoltage": batchInvalid},
+		},
+		{
+			name: "output voltage of another voltage class",
+			body: `{"outputSourcePriority": "utility", "outputRatingVoltage": 120}`,
+			want: map[string]string{"outputSourcePriority": batchSkipped, "outputRatingVoltage": batchInvalid},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _, sc := newTestApplication(t, nil)
+
+			code, response := applySettings(t, app, tt.body)
+			if code != http.StatusBadRequest {
+				t.Fatalf("got status code %d, want %d: %s", code, http.StatusBadRequest, response.Message)
+			}
+			checkResults(t, response, tt.want)
+
+			if sc.outputSourcePriority != axpert.OutputSBUFirst {
+				t.Error("a setting was changed although the batch is invalid")
+			}
+		})
+	}
+}
+
+func TestApplySettingsRollback(t *testing.T) {
+	app, _, sc := newTestApplication(t, nil)
+
+	// The inverter refuses the float voltage, as its battery type changed since the settings were collected
+	sc.batteryType = axpert.AGM
+
+	code, response := applySettings(t, app, `{"outputSourcePriority": "utility", "batteryFloatVoltage": 55, "maxACChargeCurrent": 20}`)
+	if code != http.StatusInternalServerError {
+		t.Fatalf("got status code %d, want %d", code, http.StatusInternalServerError)
+	}
+
+	checkResults(t, response, map[string]string{
+		"outputSourcePriority": batchRolledBack,
+		"batteryFloatVoltage":  batchFailed,
+		"maxACChargeCurrent":   batchSkipped,
+	})
+
+	if sc.outputSourcePriority != axpert.OutputSBUFirst || sc.maxACChargingCurrent != 30 {
+		t.Errorf("settings were not rolled back: output source priority %d, max AC charge current %d", sc.outputSourcePriority, sc.maxACChargingCurrent)
+	}
+}
+
+func TestApplySettingsRollbackBatteryProfile(t *testing.T) {
+	app, _, sc := newTestApplication(t, func(sc *SimulatedConnector) {
+		sc.batteryBulkVoltage = 58
+		sc.batteryFloatVoltage = 57
+	})
+
+	// The inverter refuses the buzzer, which is applied after the battery type
+	delete(sc.flags, axpert.Buzzer)
+
+	code, response := applySettings(t, app, `{"batteryType": "agm", "flags": {"buzzer": false}}`)
+	if code != http.StatusInternalServerError {
+		t.Fatalf("got status code %d, want %d", code, http.StatusInternalServerError)
+	}
+
+	// The voltages the AGM profile overrode are restored after the battery type, the bulk voltage
+	// before the float voltage, which may not exceed it
+	checkResults(t, response, map[string]string{
+		"batteryType":         batchRolledBack,
+		"batteryBulkVoltage":  batchRolledBack,
+		"batteryFloatVoltage": batchRolledBack,
+		"flags.buzzer":        batchFailed,
+	})
+
+	if sc.batteryType != axpert.User || sc.batteryBulkVoltage != 58 || sc.batteryFloatVoltage != 57 {
+		t.Errorf("got battery type %d with bulk voltage %g and float voltage %g, want user with 58 and 57",
+			sc.batteryType, sc.batteryBulkVoltage, sc.batteryFloatVoltage)
+	}
+}
+
+func TestCommandWaitsForBatch(t *testing.T) {
+	app, inv, sc := newTestApplication(t, nil)
+
+	// Hold the lock as a running batch does
+	inv.batch.Lock()
+
+	done := make(chan int)
+	go func() {
+		r := httptest.NewRequest(http.MethodPost, "/api/command/setOutputPriority", strings.NewReader(`{"value": "utility", "serialno": "90000000000001"}`))
+		w := httptest.NewRecorder()
+		app.Routes().ServeHTTP(w, r)
+		done <- w.Code
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("command was executed during a batch")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	inv.batch.Unlock()
+
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("got status code %d, want %d", code, http.StatusOK)
+	}
+	if sc.outputSourcePriority != axpert.OutputUtilityFirst {
+		t.Error("command was not executed after the batch")
+	}
+}
+
+func TestReconnectWaitsForBatch(t *testing.T) {
+	app, inv, _ := newTestApplication(t, nil)
+
+	inv.mu.Lock()
+	inv.closeConnector()
+	inv.linkMu.Lock()
+	inv.Connector = nil
+	inv.linkMu.Unlock()
+	inv.mu.Unlock()
+
+	// Hold the lock as a running batch does
+	inv.batch.Lock()
+
+	done := make(chan error)
+	go func() {
+		done <- app.attachConnector(NewSimulatedConnector(0), "sim1", nil)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("connector was swapped during a batch")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	inv.batch.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if info := inv.info(); !info.Connected || info.Device != "sim1" {
+		t.Errorf("got device %s connected %t, want sim1 connected", info.Device, info.Connected)
+	}
+}
+
+func TestReportedOverrides(t *testing.T) {
+	app, inv, _ := newTestApplication(t, nil)
+
+	// The inverter applied other voltages than the profile is expected to
+	inv.CurrentSettings.BatteryBulkVoltage = 57.6
+	inv.CurrentSettings.BatteryFloatVoltage = 54.4
+
+	overrides := []SettingOverride{
+		{Key: "batteryBulkVoltage", Current: float32(58), New: float32(56.4)},
+		{Key: "batteryFloatVoltage", Current: float32(57), New: nil},
+	}
+	want := []SettingOverride{
+		{Key: "batteryBulkVoltage", Current: float32(58), New: float32(57.6)},
+		{Key: "batteryFloatVoltage", Current: float32(57), New: float32(54.4)},
+	}
+
+	if got := app.reportedOverrides(inv.SerialNo, overrides); !slices.Equal(got, want) {
+		t.Errorf("got overrides %+v, want %+v", got, want)
+	}
+}
@@ -2,22 +2,84 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/marevers/energia/pkg/connector"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Represents the application root
 type Application struct {
 	Prometheus *Prometheus
 	Inverters  []*Inverter
+	Recorder   *Recorder
+	Energy     *EnergyMeter
+	mu         sync.RWMutex
+
+	// Polling interval per query group, nil until metrics collection is started
+	schedule map[string]time.Duration
 }
 
 // Represents an inverter
 type Inverter struct {
-	Connector       *connector.USBConnector
+	Connector       connector.Connector
+	Device          string
 	SerialNo        string
+	Identity        Identity
 	CurrentSettings *CurrentSettings
+	Warnings        []ActiveWarning
 	mu              sync.Mutex
+	reopen          opener
+	failures        int
+	groupErrs       map[string]bool
+	unsupported     map[string]bool
+	breaker         CircuitBreaker
+
+	// Held in addition to mu while the connector, device or identity are changed, so they can be read
+	// for the API without waiting for a collection cycle in progress
+	linkMu sync.Mutex
+
+	// Whether the last collection cycle failed, read without the inverter lock to export the scrape error
+	scrapeErr atomic.Bool
+
+	// Labels of the exported units of the parallel cluster by serial number
+	parallelUnits map[string]prometheus.Labels
+
+	// Held while an exchange is in progress, including one that was abandoned after its deadline
+	busy chan struct{}
+
+	// Held while a batch of settings is validated, applied and rolled back, and while a single control
+	// command is executed and read back, so control writes to the inverter do not interleave and the
+	// connector is not swapped underneath them
+	batch sync.Mutex
+}
+
+// Returns a snapshot of the inverters, safe to iterate while inverters are being added
+func (a *Application) inverterList() []*Inverter {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return append([]*Inverter(nil), a.Inverters...)
+}
+
+// Adds an inverter to the application and starts polling it if metrics collection is running
+func (a *Application) addInverter(inv *Inverter) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.Inverters = append(a.Inverters, inv)
+	if a.schedule != nil {
+		go a.pollInverter(inv, a.schedule)
+	}
+}
+
+// Represents the identity of an inverter, values the inverter does not report are empty
+type Identity struct {
+	ProtocolID        string `json:"protocolid"`
+	FirmwareMain      string `json:"firmwaremain"`
+	FirmwareSecondary string `json:"firmwaresecondary"`
+	Model             string `json:"model"`
 }
 
 // Represents the current inverter settings
@@ -30,4 +92,26 @@ type CurrentSettings struct {
 	BatteryRedischargeVoltage float32 `json:"batteryRedischargeVoltage"`
 	BatteryCutoffVoltage      float32 `json:"batteryCutoffVoltage"`
 	BatteryFloatVoltage       float32 `json:"batteryFloatVoltage"`
+	BatteryBulkVoltage        float32 `json:"batteryBulkVoltage"`
+	BatteryRatingVoltage      float32 `json:"batteryRatingVoltage"`
+	BatteryType               string  `json:"batteryType"`
+	MaxACChargeCurrent        int     `json:"maxACChargeCurrent"`
+	MaxChargeCurrent          int     `json:"maxChargeCurrent"`
+	GridRatingVoltage         float32 `json:"gridRatingVoltage"`
+	GridRatingCurrent         float32 `json:"gridRatingCurrent"`
+	OutputRatingVoltage       float32 `json:"outputRatingVoltage"`
+	OutputRatingFrequency     float32 `json:"outputRatingFrequency"`
+	OutputRatingCurrent       float32 `json:"outputRatingCurrent"`
+	OutputRatingApparentPower int     `json:"outputRatingApparentPower"`
+	OutputRatingActivePower   int     `json:"outputRatingActivePower"`
+	InputVoltageRange         string  `json:"inputVoltageRange"`
+	MachineType               string  `json:"machineType"`
+	Topology                  string  `json:"topology"`
+	OutputMode                string  `json:"outputMode"`
+	ParallelMaxNumber         int     `json:"parallelMaxNumber"`
+	ParallelPVOK              string  `json:"parallelPVOK"`
+	PVPowerBalance            string  `json:"pvPowerBalance"`
+
+	// Device flags (QFLAG) by name, flags the inverter does not report are left out
+	Flags map[string]bool `json:"flags"`
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/marevers/energia/pkg/connector"
+	log "github.com/sirupsen/logrus"
+)
+
+// Represents a connector to an inverter behind a serial-to-TCP bridge (e.g. ser2net in raw mode)
+type TCPConnector struct {
+	address string
+	timeout time.Duration
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+// Creates a TCP connector for the given host:port address, using timeout as the deadline for
+// dialing and for every read and write
+func NewTCPConnector(address string, timeout time.Duration) *TCPConnector {
+	return &TCPConnector{
+		address: address,
+		timeout: timeout,
+	}
+}
+
+// Returns the host:port address of the connector
+func (tc *TCPConnector) Address() string {
+	return tc.address
+}
+
+// Connects to the bridge, if not already connected
+func (tc *TCPConnector) Open() error {
+	if tc.conn != nil {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", tc.address, tc.timeout)
+	if err != nil {
+		return err
+	}
+
+	tc.conn = conn
+	tc.reader = bufio.NewReader(conn)
+
+	return nil
+}
+
+// Closes the connection to the bridge
+func (tc *TCPConnector) Close() {
+	if tc.conn == nil {
+		return
+	}
+
+	tc.conn.Close()
+	tc.conn = nil
+	tc.reader = nil
+}
+
+func (tc *TCPConnector) ReadUntilCR() ([]byte, error) {
+	return tc.Read(0x0d)
+}
+
+// Reads until the terminator is received. The connection is dropped on any error so a late
+// response can not be mistaken for the answer to the next request.
+func (tc *TCPConnector) Read(terminator byte) ([]byte, error) {
+	if tc.conn == nil {
+		return nil, fmt.Errorf("not connected to %s", tc.address)
+	}
+
+	if err := tc.conn.SetReadDeadline(time.Now().Add(tc.timeout)); err != nil {
+		tc.Close()
+		return nil, err
+	}
+
+	b, err := tc.reader.ReadBytes(terminator)
+	if err != nil {
+		tc.Close()
+		return nil, fmt.Errorf("failed to read from %s: %w", tc.address, err)
+	}
+
+	return b, nil
+}
+
+// Writes the bytes to the bridge. If the connection was dropped, it is reestablished first and
+// a failed write is retried once on a fresh connection.
+func (tc *TCPConnector) Write(b []byte) error {
+	err := tc.write(b)
+	if err == nil {
+		return nil
+	}
+
+	log.Warnf("write to %s failed, reconnecting: %s", tc.address, err)
+	tc.Close()
+
+	return tc.write(b)
+}
+
+func (tc *TCPConnector) write(b []byte) error {
+	if err := tc.Open(); err != nil {
+		return err
+	}
+
+	if err := tc.conn.SetWriteDeadline(time.Now().Add(tc.timeout)); err != nil {
+		return err
+	}
+
+	n, err := tc.conn.Write(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return fmt.Errorf("write incomplete, %d of %d written", n, len(b))
+	}
+
+	return nil
+}
+
+// Wraps a connector that does not recover from a read error, such as the serial connector, whose
+// scanner keeps returning the first read error. Like the TCP connector, the port is closed on a read
+// error, so a late response can not be mistaken for the next answer, and reopened before the next write.
+type ReopeningConnector struct {
+	connector.Connector
+	name   string
+	closed bool
+}
+
+// Wraps an opened connector of the named device
+func NewReopeningConnector(cr connector.Connector, name string) *ReopeningConnector {
+	return &ReopeningConnector{Connector: cr, name: name}
+}
+
+// Opens the device, if it is not open
+func (rc *ReopeningConnector) Open() error {
+	if !rc.closed {
+		return nil
+	}
+
+	if err := rc.Connector.Open(); err != nil {
+		return err
+	}
+	rc.closed = false
+
+	return nil
+}
+
+// Closes the device, if it is open
+func (rc *ReopeningConnector) Close() {
+	if rc.closed {
+		return
+	}
+
+	rc.Connector.Close()
+	rc.closed = true
+}
+
+func (rc *ReopeningConnector) ReadUntilCR() ([]byte, error) {
+	return rc.Read(0x0d)
+}
+
+// Reads until the terminator is received. The device is closed on any error.
+func (rc *ReopeningConnector) Read(terminator byte) ([]byte, error) {
+	if rc.closed {
+		return nil, fmt.Errorf("%s is not open", rc.name)
+	}
+
+	b, err := rc.Connector.Read(terminator)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("failed to read from %s: %w", rc.name, err)
+	}
+
+	return b, nil
+}
+
+// Writes the bytes to the device, reopening it first if it was closed after an error
+func (rc *ReopeningConnector) Write(b []byte) error {
+	if err := rc.Open(); err != nil {
+		return fmt.Errorf("failed to reopen %s: %w", rc.name, err)
+	}
+
+	if err := rc.Connector.Write(b); err != nil {
+		rc.Close()
+		return err
+	}
+
+	return nil
+}
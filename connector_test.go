@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// Starts a local TCP listener that handles every connection with the given function and returns its
+// address and the number of accepted connections
+func startListener(t *testing.T, handle func(net.Conn)) (string, *atomic.Int32) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go handle(conn)
+		}
+	}()
+
+	return l.Addr().String(), accepted
+}
+
+// Echoes every frame terminated by CR back to the sender, like an inverter answering a request
+func echo(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := r.ReadBytes(cr)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// Keeps connections open without ever answering
+func silent(conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, 64)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+func TestTCPConnectorRoundTrip(t *testing.T) {
+	addr, _ := startListener(t, echo)
+
+	tc := NewTCPConnector(addr, time.Second)
+	if err := tc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	frame := []byte("(QPIGS\r")
+	if err := tc.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := tc.ReadUntilCR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, frame) {
+		t.Errorf("got %q, want %q", got, frame)
+	}
+}
+
+func TestTCPConnectorReadDeadline(t *testing.T) {
+	addr, _ := startListener(t, silent)
+
+	timeout := 100 * time.Millisecond
+	tc := NewTCPConnector(addr, timeout)
+	if err := tc.Write([]byte("QPIGS\r")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := tc.ReadUntilCR(); err == nil {
+		t.Fatal("expected a read error from a bridge that does not answer")
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 10*timeout {
+		t.Errorf("read returned after %s, want about %s", elapsed, timeout)
+	}
+
+	// The connection is dropped, so a late response can not be read as the next answer
+	if tc.conn != nil {
+		t.Error("connection was not closed after the read deadline")
+	}
+}
+
+func TestTCPConnectorCloseOnError(t *testing.T) {
+	addr, _ := startListener(t, func(conn net.Conn) {
+		conn.Write([]byte("(partial"))
+		conn.Close()
+	})
+
+	tc := NewTCPConnector(addr, time.Second)
+	if err := tc.Write([]byte("QPIGS\r")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tc.ReadUntilCR(); err == nil {
+		t.Fatal("expected a read error from a dropped connection")
+	}
+	if tc.conn != nil {
+		t.Error("connection was not closed after the read error")
+	}
+
+	if _, err := tc.ReadUntilCR(); err == nil {
+		t.Error("expected an error reading without a connection")
+	}
+}
+
+func TestTCPConnectorReconnectOnWrite(t *testing.T) {
+	addr, accepted := startListener(t, echo)
+
+	tc := NewTCPConnector(addr, time.Second)
+	if err := tc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	// Break the connection underneath the connector, so the next write fails
+	tc.conn.Close()
+
+	frame := []byte("(QMOD\r")
+	if err := tc.Write(frame); err != nil {
+		t.Fatalf("write was not retried on a fresh connection: %s", err)
+	}
+
+	got, err := tc.ReadUntilCR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, frame) {
+		t.Errorf("got %q, want %q", got, frame)
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("bridge accepted %d connections, want 2", n)
+	}
+}
+
+func TestTCPConnectorWriteWithoutBridge(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	tc := NewTCPConnector(addr, 100*time.Millisecond)
+	if err := tc.Write([]byte("QPI\r")); err == nil {
+		t.Fatal("expected a write error without a bridge")
+	}
+	if tc.conn != nil {
+		t.Error("connector is connected without a bridge")
+	}
+}
+
+// Answers every request with an acknowledgement, except for reads that were set up to time out. Like
+// the serial connector, every read after a failed read fails until the port is reopened.
+type stickyConnector struct {
+	timeouts int
+	failed   bool
+	opens    int
+}
+
+func (sc *stickyConnector) Open() error {
+	sc.opens++
+	sc.failed = false
+	return nil
+}
+
+func (sc *stickyConnector) Close() {}
+
+func (sc *stickyConnector) Write(b []byte) error {
+	return nil
+}
+
+func (sc *stickyConnector) ReadUntilCR() ([]byte, error) {
+	return sc.Read(cr)
+}
+
+func (sc *stickyConnector) Read(terminator byte) ([]byte, error) {
+	if sc.timeouts > 0 {
+		sc.timeouts--
+		sc.failed = true
+	}
+	if sc.failed {
+		return nil, serial.ErrTimeout
+	}
+
+	return encodeFrame([]byte("(ACK")), nil
+}
+
+func TestReopeningConnectorAfterReadTimeout(t *testing.T) {
+	setOption(t, retryBackoff, time.Millisecond)
+
+	sc := &stickyConnector{timeouts: 1}
+	inv := &Inverter{
+		Connector: NewReopeningConnector(sc, "/dev/ttyUSB0"),
+		SerialNo:  "90000000000001",
+		busy:      make(chan struct{}, 1),
+	}
+
+	// The first attempt times out, the retry reopens the port and succeeds
+	if err := sendCommand(newExchangeConnector(inv, nil), "PEa"); err != nil {
+		t.Fatalf("exchange after a read timeout failed: %s", err)
+	}
+	if sc.opens != 1 {
+		t.Errorf("port was reopened %d times, want 1", sc.opens)
+	}
+
+	// Later exchanges use the reopened port
+	if err := sendCommand(newExchangeConnector(inv, nil), "PDa"); err != nil {
+		t.Fatalf("exchange on the reopened port failed: %s", err)
+	}
+	if sc.opens != 1 {
+		t.Errorf("port was reopened %d times, want 1", sc.opens)
+	}
+}
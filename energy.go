@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marevers/energia/pkg/axpert"
+	"github.com/marevers/energia/pkg/connector"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Samples further apart than this are not integrated, as the power in between is unknown
+const maxIntegrationGap = 5 * time.Minute
+
+// Represents the power flows of an inverter in watts, derived from the general status
+type PowerFlows struct {
+	PV1              float64
+	PV2              float64
+	PV3              float64
+	PV               float64
+	BatteryCharge    float64
+	BatteryDischarge float64
+	Load             float64
+	GridImport       float64
+}
+
+// Derives the power flows from the general status. The grid import is estimated from the balance of
+// the other flows, ignoring conversion losses.
+func derivePowerFlows(dsp *axpert.DeviceStatusParams) PowerFlows {
+	pf := PowerFlows{
+		PV1:              float64(dsp.PVInputVoltage1) * float64(dsp.PVInputCurrent1),
+		PV2:              float64(dsp.PVInputVoltage2) * float64(dsp.PVInputCurrent2),
+		PV3:              float64(dsp.PVInputVoltage3) * float64(dsp.PVInputCurrent3),
+		BatteryCharge:    float64(dsp.BatteryVoltage) * float64(dsp.BatteryChargingCurrent),
+		BatteryDischarge: float64(dsp.BatteryVoltage) * float64(dsp.BatteryDischargeCurrent),
+		Load:             float64(dsp.ACOutputActivePower),
+	}
+	pf.PV = pf.PV1 + pf.PV2 + pf.PV3
+	pf.GridImport = max(0, pf.Load+pf.BatteryCharge-pf.PV-pf.BatteryDischarge)
+
+	return pf
+}
+
+// Returns the net battery power in watts, positive while charging
+func (pf PowerFlows) Battery() float64 {
+	return pf.BatteryCharge - pf.BatteryDischarge
+}
+
+// Returns the share of the load that is not supplied by the grid
+func (pf PowerFlows) SelfConsumptionRatio() float64 {
+	if pf.Load <= 0 {
+		return 1
+	}
+
+	return max(0, pf.Load-pf.GridImport) / pf.Load
+}
+
+// Represents the energy totals of an inverter in kWh
+type EnergyTotals struct {
+	PV               float64 `json:"pv"`
+	BatteryCharge    float64 `json:"batteryCharge"`
+	BatteryDischarge float64 `json:"batteryDischarge"`
+	Load             float64 `json:"load"`
+	GridImport       float64 `json:"gridImport"`
+}
+
+// Represents a power sample of an inverter
+type powerSample struct {
+	flows PowerFlows
+	time  time.Time
+}
+
+// Integrates the power flows of inverters over time into energy totals, which are persisted to a state
+// file so they survive restarts
+type EnergyMeter struct {
+	mu       sync.Mutex
+	path     string
+	totals   map[string]*EnergyTotals
+	last     map[string]powerSample
+	exported map[string]bool
+	dirty    bool
+}
+
+// Creates an energy meter and loads the totals from the state file. Without a path, the totals
+// are kept in memory only.
+func NewEnergyMeter(path string) (*EnergyMeter, error) {
+	m := &EnergyMeter{
+		path:     path,
+		totals:   make(map[string]*EnergyTotals),
+		last:     make(map[string]powerSample),
+		exported: make(map[string]bool),
+	}
+
+	if path == "" {
+		return m, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &m.totals); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Adds a power sample of an inverter and returns the energy in kWh by which its counters must be
+// increased. The first sample of an inverter returns the persisted totals, as its counters start at zero.
+func (m *EnergyMeter) Add(sn string, now time.Time, pf PowerFlows) EnergyTotals {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totals[sn]
+	if !ok {
+		t = &EnergyTotals{}
+		m.totals[sn] = t
+	}
+
+	var delta EnergyTotals
+	if !m.exported[sn] {
+		delta = *t
+		m.exported[sn] = true
+	}
+
+	prev, ok := m.last[sn]
+	m.last[sn] = powerSample{flows: pf, time: now}
+
+	dt := now.Sub(prev.time)
+	if !ok || dt <= 0 || dt > maxIntegrationGap {
+		return delta
+	}
+
+	// Trapezoidal integration of watts over hours into kWh
+	h := dt.Hours() / 1000
+	step := EnergyTotals{
+		PV:               (prev.flows.PV + pf.PV) / 2 * h,
+		BatteryCharge:    (prev.flows.BatteryCharge + pf.BatteryCharge) / 2 * h,
+		BatteryDischarge: (prev.flows.BatteryDischarge + pf.BatteryDischarge) / 2 * h,
+		Load:             (prev.flows.Load + pf.Load) / 2 * h,
+		GridImport:       (prev.flows.GridImport + pf.GridImport) / 2 * h,
+	}
+
+	t.PV += step.PV
+	t.BatteryCharge += step.BatteryCharge
+	t.BatteryDischarge += step.BatteryDischarge
+	t.Load += step.Load
+	t.GridImport += step.GridImport
+	m.dirty = true
+
+	delta.PV += step.PV
+	delta.BatteryCharge += step.BatteryCharge
+	delta.BatteryDischarge += step.BatteryDischarge
+	delta.Load += step.Load
+	delta.GridImport += step.GridImport
+
+	return delta
+}
+
+// Writes the totals to the state file if they changed since the last save
+func (m *EnergyMeter) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.path == "" || !m.dirty {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(m.totals, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a crash does not leave a truncated state file behind
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		return err
+	}
+
+	m.dirty = false
+
+	return nil
+}
+
+// Periodically saves the totals, so the state file is not rewritten on every sample
+func (m *EnergyMeter) saveEvery(t time.Duration) {
+	tck := time.NewTicker(t)
+	defer tck.Stop()
+
+	for range tck.C {
+		if err := m.Save(); err != nil {
+			log.Errorln("failed to save energy state:", err)
+		}
+	}
+}
+
+// Represents an energy counter kept by the inverter firmware
+type energyQuery struct {
+	Source string
+	Period string
+	Prefix string
+
+	// Layout of the date appended to the prefix
+	DateLayout string
+
+	// Factor to convert the reported value to kWh
+	Scale float64
+}
+
+// Energy counters of the inverter firmware. The totals, yearly and monthly values are reported in kWh,
+// the daily values in Wh.
+var energyQueries = []energyQuery{
+	{Source: "pv", Period: "total", Prefix: "QET", Scale: 1},
+	{Source: "pv", Period: "year", Prefix: "QEY", DateLayout: "2006", Scale: 1},
+	{Source: "pv", Period: "month", Prefix: "QEM", DateLayout: "200601", Scale: 1},
+	{Source: "pv", Period: "day", Prefix: "QED", DateLayout: "20060102", Scale: 0.001},
+	{Source: "load", Period: "total", Prefix: "QLT", Scale: 1},
+	{Source: "load", Period: "year", Prefix: "QLY", DateLayout: "2006", Scale: 1},
+	{Source: "load", Period: "month", Prefix: "QLM", DateLayout: "200601", Scale: 1},
+	{Source: "load", Period: "day", Prefix: "QLD", DateLayout: "20060102", Scale: 0.001},
+}
+
+// Reads an energy counter of the inverter firmware for the period containing the given date and
+// returns it in kWh. Returns errNotSupported if the inverter answers NAK.
+func readEnergyCounter(c *exchangeConnector, q energyQuery, date time.Time) (float64, error) {
+	return observe(c, q.Prefix, func(c connector.Connector) (float64, error) {
+		resp, err := sendRequest(c, q.Prefix+date.Format(q.DateLayout))
+		if err != nil {
+			return 0, err
+		}
+		if resp == "NAK" {
+			return 0, fmt.Errorf("%w, %s", errNotSupported, q.Prefix)
+		}
+
+		n, err := strconv.ParseUint(resp, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return float64(n) * q.Scale, nil
+	})
+}
+
+// Collects the energy counters of the inverter firmware as Prometheus counters. Yearly, monthly and
+// daily values reset at the start of their period, which rate() and increase() handle as counter resets.
+type EnergyCounterCollector struct {
+	mu     sync.Mutex
+	desc   *prometheus.Desc
+	values map[string]map[energyQuery]float64
+}
+
+// Creates an energy counter collector
+func NewEnergyCounterCollector() *EnergyCounterCollector {
+	return &EnergyCounterCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "inverter_energy_kwh_total"),
+			"Energy in kWh as counted by the inverter firmware - source pv: produced, load: consumed",
+			[]string{LabelSerialNumber, "source", "period"}, nil,
+		),
+		values: make(map[string]map[energyQuery]float64),
+	}
+}
+
+// Sets the value of an energy counter of an inverter
+func (ec *EnergyCounterCollector) Set(sn string, q energyQuery, v float64) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ec.values[sn] == nil {
+		ec.values[sn] = make(map[energyQuery]float64)
+	}
+	ec.values[sn][q] = v
+}
+
+// Removes an energy counter of an inverter
+func (ec *EnergyCounterCollector) Delete(sn string, q energyQuery) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	delete(ec.values[sn], q)
+}
+
+func (ec *EnergyCounterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ec.desc
+}
+
+func (ec *EnergyCounterCollector) Collect(ch chan<- prometheus.Metric) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	for sn, values := range ec.values {
+		for q, v := range values {
+			ch <- prometheus.MustNewConstMetric(ec.desc, prometheus.CounterValue, v, sn, q.Source, q.Period)
+		}
+	}
+}
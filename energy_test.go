@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Returns true if the totals are equal, allowing for rounding errors
+func totalsEqual(a, b EnergyTotals) bool {
+	eq := func(x, y float64) bool { return math.Abs(x-y) < 1e-9 }
+
+	return eq(a.PV, b.PV) && eq(a.BatteryCharge, b.BatteryCharge) && eq(a.BatteryDischarge, b.BatteryDischarge) &&
+		eq(a.Load, b.Load) && eq(a.GridImport, b.GridImport)
+}
+
+func TestEnergyMeterAdd(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		dt    time.Duration
+		first PowerFlows
+		next  PowerFlows
+		want  EnergyTotals
+	}{
+		{
+			name:  "trapezoidal integration",
+			dt:    time.Minute,
+			first: PowerFlows{PV: 1000, Load: 600, GridImport: 0},
+			next:  PowerFlows{PV: 2000, Load: 600, GridImport: 120},
+			// (1000 + 2000) / 2 W for 1/60 h
+			want: EnergyTotals{PV: 0.025, Load: 0.01, GridImport: 0.001},
+		},
+		{
+			name:  "battery",
+			dt:    30 * time.Second,
+			first: PowerFlows{BatteryCharge: 480},
+			next:  PowerFlows{BatteryDischarge: 240},
+			want:  EnergyTotals{BatteryCharge: 0.002, BatteryDischarge: 0.001},
+		},
+		{
+			name:  "gap at the limit",
+			dt:    maxIntegrationGap,
+			first: PowerFlows{Load: 1200},
+			next:  PowerFlows{Load: 1200},
+			want:  EnergyTotals{Load: 0.1},
+		},
+		{
+			name:  "gap too large",
+			dt:    maxIntegrationGap + time.Second,
+			first: PowerFlows{Load: 1200},
+			next:  PowerFlows{Load: 1200},
+		},
+		{
+			name:  "sample out of order",
+			dt:    -time.Minute,
+			first: PowerFlows{Load: 1200},
+			next:  PowerFlows{Load: 1200},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewEnergyMeter("")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := m.Add("sn", start, tt.first); got != (EnergyTotals{}) {
+				t.Fatalf("got %+v for the first sample, want nothing", got)
+			}
+
+			if got := m.Add("sn", start.Add(tt.dt), tt.next); !totalsEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got := *m.totals["sn"]; !totalsEqual(got, tt.want) {
+				t.Errorf("got totals %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnergyMeterSaveAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "energy.json")
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	pf := PowerFlows{PV: 3000, Load: 1000}
+
+	m, err := NewEnergyMeter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is written before a sample was integrated
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("state file was written without changes: %v", err)
+	}
+
+	m.Add("sn", start, pf)
+	m.Add("sn", start.Add(3*time.Minute), pf)
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The state file is replaced by renaming a temporary file, which must not be left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "energy.json" {
+		t.Errorf("got files %v, want only the state file", entries)
+	}
+
+	saved := EnergyTotals{PV: 0.15, Load: 0.05}
+
+	reloaded, err := NewEnergyMeter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The persisted totals are exported once with the first sample after a restart, which is not
+	// integrated with the samples before the restart
+	if got := reloaded.Add("sn", start.Add(time.Hour), pf); !totalsEqual(got, saved) {
+		t.Errorf("got %+v for the first sample after reloading, want the persisted totals %+v", got, saved)
+	}
+	want := EnergyTotals{PV: 0.05, Load: 1.0 / 60}
+	if got := reloaded.Add("sn", start.Add(time.Hour+time.Minute), pf); !totalsEqual(got, want) {
+		t.Errorf("got %+v for the second sample after reloading, want %+v", got, want)
+	}
+
+	if err := reloaded.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := NewEnergyMeter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = EnergyTotals{PV: 0.2, Load: 0.05 + 1.0/60}
+	if got := *again.totals["sn"]; !totalsEqual(got, want) {
+		t.Errorf("got totals %+v after saving twice, want %+v", got, want)
+	}
+}
+
+func TestNewEnergyMeterInvalidState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "energy.json")
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewEnergyMeter(path); err == nil {
+		t.Error("got no error for an invalid state file")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+	"github.com/marevers/energia/pkg/connector"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errTimeout     = errors.New("timeout waiting for response")
+	errCircuitOpen = errors.New("circuit breaker is open")
+
+	// Returned by queries the inverter answers with NAK
+	errNotSupported = errors.New("query not supported")
+)
+
+// Classes of failed queries
+const (
+	errClassTimeout = "timeout"
+	errClassCRC     = "crc"
+	errClassNAK     = "nak"
+	errClassParse   = "parse"
+	errClassIO      = "io"
+)
+
+// Represents an exchange that failed after all retries, together with the class of the failure
+type ExchangeError struct {
+	Class string
+	Err   error
+}
+
+func (e *ExchangeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExchangeError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the class of an error returned by a connector
+func exchangeErrorClass(err error) string {
+	switch {
+	case errors.Is(err, errTimeout), errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, serial.ErrTimeout):
+		return errClassTimeout
+	case errors.Is(err, errCRC), errors.Is(err, errInvalidFrame):
+		return errClassCRC
+	default:
+		return errClassIO
+	}
+}
+
+// Represents the state of a circuit breaker
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "halfopen"
+	default:
+		return "unknown"
+	}
+}
+
+// Stops exchanges with an inverter that keeps failing. After a backoff, a single exchange is let
+// through to probe the inverter; if it fails, the backoff is doubled. The breaker has its own lock, so
+// its state can be read without waiting for a collection cycle in progress.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	openUntil time.Time
+	backoff   time.Duration
+}
+
+// Returns the state of the breaker and the time until which it stays open
+func (b *CircuitBreaker) State() (BreakerState, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state, b.openUntil
+}
+
+// Returns true if the breaker is open and the backoff has not expired yet
+func (b *CircuitBreaker) isOpen(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state == BreakerOpen && now.Before(b.openUntil)
+}
+
+// Returns true if an exchange may be attempted
+func (b *CircuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && now.Before(b.openUntil) {
+		return false
+	}
+
+	if b.state == BreakerOpen {
+		b.state = BreakerHalfOpen
+	}
+
+	return true
+}
+
+// Records a successful exchange
+func (b *CircuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.backoff = 0
+}
+
+// Records a failed exchange and opens the breaker if the threshold is reached or the probe failed
+func (b *CircuitBreaker) failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+
+	if b.state != BreakerHalfOpen && b.failures < *breakerThreshold {
+		return
+	}
+
+	switch {
+	case b.backoff == 0:
+		b.backoff = *breakerBackoff
+	case b.state == BreakerHalfOpen:
+		b.backoff = min(2*b.backoff, *breakerMaxBackoff)
+	}
+
+	b.state = BreakerOpen
+	b.openUntil = now.Add(b.backoff)
+}
+
+// Closes the breaker and forgets previous failures and backoff
+func (b *CircuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.backoff = 0
+}
+
+// Returns the connector of the inverter wrapped so every exchange has a deadline, is retried with
+// backoff and is subject to the circuit breaker of the inverter. Returns an error if the inverter is
+// disconnected. The inverter lock must be held while the connector is used.
+func (a *Application) conn(inv *Inverter) (*exchangeConnector, error) {
+	if inv.Connector == nil {
+		return nil, fmt.Errorf("inverter with serial number %s is disconnected", inv.SerialNo)
+	}
+
+	return newExchangeConnector(inv, a.Prometheus), nil
+}
+
+// Creates an exchange connector for the current connector of the inverter. The circuit breaker state
+// is only exported if metrics are given.
+func newExchangeConnector(inv *Inverter, p *Prometheus) *exchangeConnector {
+	return &exchangeConnector{
+		inv:  inv,
+		raw:  inv.Connector,
+		prom: p,
+	}
+}
+
+// Represents a connector that performs a complete request/response exchange on write, so the
+// exchange can be bounded by a deadline and retried as a whole
+type exchangeConnector struct {
+	inv     *Inverter
+	raw     connector.Connector
+	prom    *Prometheus
+	pending []byte
+
+	// Whether the inverter answered the last request with NAK
+	nak bool
+
+	// Whether requests are sent once without retries and without counting toward the circuit breaker,
+	// for queries that are allowed to fail
+	probe bool
+}
+
+func (ec *exchangeConnector) Open() error {
+	return ec.raw.Open()
+}
+
+func (ec *exchangeConnector) Close() {
+	ec.raw.Close()
+}
+
+func (ec *exchangeConnector) ReadUntilCR() ([]byte, error) {
+	return ec.Read(cr)
+}
+
+// Returns the response of the last exchange
+func (ec *exchangeConnector) Read(terminator byte) ([]byte, error) {
+	if ec.pending == nil {
+		return nil, errors.New("no request pending")
+	}
+
+	resp := ec.pending
+	ec.pending = nil
+
+	return resp, nil
+}
+
+// Sends the request and waits for the response, retrying failed attempts with jittered exponential backoff
+func (ec *exchangeConnector) Write(b []byte) error {
+	ec.pending = nil
+	ec.nak = false
+
+	if ec.probe {
+		resp, err := ec.roundTrip(b)
+		if err != nil {
+			return &ExchangeError{Class: exchangeErrorClass(err), Err: err}
+		}
+		ec.pending = resp
+		ec.nak = bytes.HasPrefix(resp, []byte("(NAK"))
+		return nil
+	}
+
+	breaker := &ec.inv.breaker
+	if !breaker.allow(time.Now()) {
+		return fmt.Errorf("%w for inverter with serial number %s", errCircuitOpen, ec.inv.SerialNo)
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var resp []byte
+
+		resp, err = ec.roundTrip(b)
+		if err == nil {
+			ec.pending = resp
+			ec.nak = bytes.HasPrefix(resp, []byte("(NAK"))
+			breaker.success()
+			ec.updateBreakerState()
+			return nil
+		}
+
+		if attempt >= *retries {
+			break
+		}
+
+		d := retryDelay(attempt)
+		log.Debugf("exchange with device with serialno '%s' failed, retrying in %s: %s", ec.inv.SerialNo, d, err)
+		time.Sleep(d)
+	}
+
+	breaker.failure(time.Now())
+	ec.updateBreakerState()
+
+	return &ExchangeError{Class: exchangeErrorClass(err), Err: err}
+}
+
+// Performs a single exchange within the deadline. A hung exchange keeps the device busy until it
+// returns, so the next exchange waits for it within its own deadline instead of interleaving.
+func (ec *exchangeConnector) roundTrip(b []byte) ([]byte, error) {
+	deadline := time.NewTimer(*exchangeTimeout)
+	defer deadline.Stop()
+
+	busy := ec.inv.busy
+	select {
+	case busy <- struct{}{}:
+	case <-deadline.C:
+		return nil, fmt.Errorf("%w: device busy with previous exchange", errTimeout)
+	}
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		defer func() { <-busy }()
+
+		if err := ec.raw.Write(b); err != nil {
+			done <- result{err: err}
+			return
+		}
+
+		resp, err := ec.raw.ReadUntilCR()
+		if err == nil {
+			_, err = decodeFrame(resp)
+		}
+		done <- result{resp: resp, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.resp, r.err
+	case <-deadline.C:
+		return nil, errTimeout
+	}
+}
+
+// Closes the connector of the inverter once no exchange is in progress on it, so it is not closed
+// underneath an abandoned exchange. If the exchange does not return within the exchange timeout, the
+// connector is closed in the background as soon as it does.
+func (inv *Inverter) closeConnector() {
+	cr, busy := inv.Connector, inv.busy
+
+	deadline := time.NewTimer(*exchangeTimeout)
+	defer deadline.Stop()
+
+	select {
+	case busy <- struct{}{}:
+		cr.Close()
+		<-busy
+	case <-deadline.C:
+		log.Debugf("closing connector of inverter with serialno '%s' after the exchange in progress returns", inv.SerialNo)
+		go func() {
+			busy <- struct{}{}
+			cr.Close()
+			<-busy
+		}()
+	}
+}
+
+func (ec *exchangeConnector) updateBreakerState() {
+	if ec.prom == nil {
+		return
+	}
+
+	exportBreakerState(ec.prom, ec.inv)
+}
+
+// Exports the current circuit breaker state of an inverter
+func exportBreakerState(p *Prometheus, inv *Inverter) {
+	state, _ := inv.breaker.State()
+	p.Metrics.CircuitBreakerStateVec.WithLabelValues(inv.SerialNo).Set(float64(state))
+}
+
+// Returns the delay before retrying after the given attempt: the retry backoff doubled for every
+// attempt, with up to 50% jitter in either direction
+func retryDelay(attempt int) time.Duration {
+	d := *retryBackoff << attempt
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + rand.N(d)
+}
+
+// Runs a query through the exchange connector and records its duration and outcome in the query
+// health metrics of the inverter. Queries rejected by an open circuit breaker are not recorded.
+func observe[T any](ec *exchangeConnector, query string, fn func(c connector.Connector) (T, error)) (T, error) {
+	start := time.Now()
+	v, err := fn(ec)
+
+	if errors.Is(err, errCircuitOpen) || ec.prom == nil {
+		return v, err
+	}
+
+	m := &ec.prom.Metrics
+	labelValues := []string{ec.inv.SerialNo, query}
+
+	m.QueryDurationVec.WithLabelValues(labelValues...).Observe(time.Since(start).Seconds())
+
+	if err == nil {
+		m.QueryLastSuccessVec.WithLabelValues(labelValues...).SetToCurrentTime()
+		m.QueryConsecutiveFailuresVec.WithLabelValues(labelValues...).Set(0)
+		return v, nil
+	}
+
+	var xe *ExchangeError
+	class := errClassParse
+	switch {
+	case errors.As(err, &xe):
+		class = xe.Class
+	case ec.nak:
+		class = errClassNAK
+	}
+
+	m.QueryConsecutiveFailuresVec.WithLabelValues(labelValues...).Inc()
+	m.QueryErrorsVec.WithLabelValues(ec.inv.SerialNo, query, class).Inc()
+
+	return v, err
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// Sets a command line option for the duration of a test
+func setOption[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// Answers every request with an acknowledgement after the first failures, which return err. Reads
+// block while hang is open.
+type stubConnector struct {
+	failures atomic.Int32
+	err      error
+	hang     chan struct{}
+	writes   atomic.Int32
+}
+
+func (sc *stubConnector) Open() error {
+	return nil
+}
+
+func (sc *stubConnector) Close() {}
+
+func (sc *stubConnector) Write(b []byte) error {
+	sc.writes.Add(1)
+	return nil
+}
+
+func (sc *stubConnector) ReadUntilCR() ([]byte, error) {
+	return sc.Read(cr)
+}
+
+func (sc *stubConnector) Read(terminator byte) ([]byte, error) {
+	if sc.hang != nil {
+		<-sc.hang
+	}
+	if sc.failures.Add(-1) >= 0 {
+		return nil, sc.err
+	}
+
+	return encodeFrame([]byte("(ACK")), nil
+}
+
+// Creates an inverter of which the exchanges fail the given number of times
+func newStubInverter(failures int, err error) (*Inverter, *stubConnector) {
+	sc := &stubConnector{err: err}
+	sc.failures.Store(int32(failures))
+
+	return &Inverter{Connector: sc, SerialNo: "90000000000001", busy: make(chan struct{}, 1)}, sc
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	setOption(t, breakerThreshold, 3)
+	setOption(t, breakerBackoff, time.Minute)
+	setOption(t, breakerMaxBackoff, 3*time.Minute)
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	var b CircuitBreaker
+
+	checkState := func(want BreakerState, wantOpenUntil time.Time) {
+		t.Helper()
+
+		state, openUntil := b.State()
+		if state != want {
+			t.Fatalf("got state %s, want %s", state, want)
+		}
+		if !openUntil.Equal(wantOpenUntil) {
+			t.Fatalf("got open until %s, want %s", openUntil, wantOpenUntil)
+		}
+	}
+
+	// The breaker opens once the threshold is reached
+	b.failure(now)
+	b.failure(now)
+	checkState(BreakerClosed, time.Time{})
+	b.failure(now)
+	checkState(BreakerOpen, now.Add(time.Minute))
+
+	if b.allow(now.Add(time.Minute-time.Second)) || !b.isOpen(now.Add(time.Minute-time.Second)) {
+		t.Fatal("breaker let an exchange through before the backoff expired")
+	}
+
+	// After the backoff, a single probe is let through; a failed probe doubles the backoff
+	now = now.Add(time.Minute)
+	if !b.allow(now) {
+		t.Fatal("breaker did not let a probe through after the backoff")
+	}
+	checkState(BreakerHalfOpen, now)
+	b.failure(now)
+	checkState(BreakerOpen, now.Add(2*time.Minute))
+
+	// The backoff does not exceed the maximum
+	now = now.Add(2 * time.Minute)
+	b.allow(now)
+	b.failure(now)
+	checkState(BreakerOpen, now.Add(3*time.Minute))
+
+	// A successful probe closes the breaker and forgets the backoff
+	now = now.Add(3 * time.Minute)
+	b.allow(now)
+	b.success()
+	b.failure(now)
+	b.failure(now)
+	checkState(BreakerClosed, now)
+	b.failure(now)
+	checkState(BreakerOpen, now.Add(time.Minute))
+
+	b.reset()
+	checkState(BreakerClosed, time.Time{})
+	if b.isOpen(now) {
+		t.Error("breaker is open after a reset")
+	}
+}
+
+func TestExchangeErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: errTimeout, want: errClassTimeout},
+		{err: os.ErrDeadlineExceeded, want: errClassTimeout},
+		{err: fmt.Errorf("failed to read from /dev/ttyUSB0: %w", serial.ErrTimeout), want: errClassTimeout},
+		{err: fmt.Errorf("%w %q", errCRC, "(ACK\x00\x00\r"), want: errClassCRC},
+		{err: fmt.Errorf("%w %q", errInvalidFrame, "\r"), want: errClassCRC},
+		{err: errors.New("broken pipe"), want: errClassIO},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := exchangeErrorClass(tt.err); got != tt.want {
+				t.Errorf("got class %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchangeRetries(t *testing.T) {
+	setOption(t, retries, 2)
+	setOption(t, retryBackoff, time.Millisecond)
+	setOption(t, breakerThreshold, 5)
+
+	tests := []struct {
+		name       string
+		failures   int
+		err        error
+		probe      bool
+		wantWrites int32
+		wantClass  string
+	}{
+		{name: "success", wantWrites: 1},
+		{name: "success after retries", failures: 2, err: errors.New("broken pipe"), wantWrites: 3},
+		{name: "retries exhausted", failures: 3, err: errors.New("broken pipe"), wantWrites: 3, wantClass: errClassIO},
+		{name: "timeout", failures: 3, err: serial.ErrTimeout, wantWrites: 3, wantClass: errClassTimeout},
+		{name: "probe without retries", failures: 1, err: errors.New("broken pipe"), probe: true, wantWrites: 1, wantClass: errClassIO},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv, sc := newStubInverter(tt.failures, tt.err)
+			c := newExchangeConnector(inv, nil)
+			c.probe = tt.probe
+
+			err := sendCommand(c, "PEa")
+			if n := sc.writes.Load(); n != tt.wantWrites {
+				t.Errorf("got %d attempts, want %d", n, tt.wantWrites)
+			}
+
+			var xe *ExchangeError
+			switch {
+			case tt.wantClass == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case tt.wantClass != "" && !errors.As(err, &xe):
+				t.Errorf("got %v, want an exchange error", err)
+			case tt.wantClass != "" && xe.Class != tt.wantClass:
+				t.Errorf("got class %s, want %s", xe.Class, tt.wantClass)
+			}
+
+			// Probes do not count toward the circuit breaker
+			wantFailures := 0
+			if tt.wantClass != "" && !tt.probe {
+				wantFailures = 1
+			}
+			if inv.breaker.failures != wantFailures {
+				t.Errorf("got %d breaker failures, want %d", inv.breaker.failures, wantFailures)
+			}
+		})
+	}
+}
+
+// Answers every request with a frame of which the CRC does not match
+type corruptConnector struct {
+	stubConnector
+}
+
+func (cc *corruptConnector) ReadUntilCR() ([]byte, error) {
+	return []byte("(ACK\x00\x00\r"), nil
+}
+
+func TestExchangeCorruptResponse(t *testing.T) {
+	setOption(t, retries, 0)
+
+	inv := &Inverter{Connector: &corruptConnector{}, SerialNo: "90000000000001", busy: make(chan struct{}, 1)}
+
+	var xe *ExchangeError
+	if err := sendCommand(newExchangeConnector(inv, nil), "PEa"); !errors.As(err, &xe) || xe.Class != errClassCRC {
+		t.Errorf("got %v, want a crc error", err)
+	}
+}
+
+func TestExchangeOpensBreaker(t *testing.T) {
+	setOption(t, retries, 1)
+	setOption(t, retryBackoff, time.Millisecond)
+	setOption(t, breakerThreshold, 2)
+	setOption(t, breakerBackoff, time.Minute)
+
+	inv, sc := newStubInverter(100, errors.New("broken pipe"))
+
+	for range 2 {
+		if err := sendCommand(newExchangeConnector(inv, nil), "PEa"); err == nil {
+			t.Fatal("expected the exchange to fail")
+		}
+	}
+	if state, _ := inv.breaker.State(); state != BreakerOpen {
+		t.Fatalf("got breaker state %s, want open", state)
+	}
+
+	// The open breaker rejects exchanges without sending them
+	writes := sc.writes.Load()
+	if err := sendCommand(newExchangeConnector(inv, nil), "PEa"); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("got %v, want %v", err, errCircuitOpen)
+	}
+	if n := sc.writes.Load(); n != writes {
+		t.Errorf("got %d requests sent through an open breaker, want none", n-writes)
+	}
+}
+
+func TestExchangeDeadline(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	setOption(t, exchangeTimeout, timeout)
+	setOption(t, retries, 0)
+
+	inv, sc := newStubInverter(0, nil)
+	sc.hang = make(chan struct{})
+
+	start := time.Now()
+	err := sendCommand(newExchangeConnector(inv, nil), "PEa")
+	if !errors.Is(err, errTimeout) {
+		t.Fatalf("got %v, want %v", err, errTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 10*timeout {
+		t.Errorf("exchange returned after %s, want about %s", elapsed, timeout)
+	}
+
+	// The hung exchange keeps the device busy, so the next exchange is not sent
+	err = sendCommand(newExchangeConnector(inv, nil), "PDa")
+	if !errors.Is(err, errTimeout) || !strings.Contains(err.Error(), "device busy") {
+		t.Fatalf("got %v, want a timeout waiting for the device", err)
+	}
+	if n := sc.writes.Load(); n != 1 {
+		t.Errorf("got %d requests sent, want 1", n)
+	}
+
+	// Once the hung exchange returns, the device is free again
+	close(sc.hang)
+	setOption(t, exchangeTimeout, time.Second)
+	if err := sendCommand(newExchangeConnector(inv, nil), "PDa"); err != nil {
+		t.Errorf("exchange after the hung exchange returned failed: %s", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/marevers/energia/pkg/axpert"
+	"github.com/marevers/energia/pkg/connector"
+)
+
+// Represents a flag of the device flag status (QFLAG) that can be enabled (PE) or disabled (PD)
+type deviceFlag struct {
+	Flag axpert.DeviceFlag
+	Name string
+}
+
+// Device flags in the order of the protocol
+var deviceFlags = []deviceFlag{
+	{axpert.Buzzer, "buzzer"},
+	{axpert.OverloadBypass, "overload_bypass"},
+	{axpert.PowerSaving, "power_saving"},
+	{axpert.DisplayTimeout, "display_timeout"},
+	{axpert.OverloadRestart, "overload_restart"},
+	{axpert.OverTemperatureRestart, "over_temperature_restart"},
+	{axpert.BacklightOn, "backlight"},
+	{axpert.PrimarySourceInterruptAlarm, "primary_source_interrupt_alarm"},
+	{axpert.FaultCodeRecord, "fault_code_record"},
+	{axpert.DataLogPopUp, "data_log_popup"},
+}
+
+// Returns the device flag with the given name
+func findDeviceFlag(name string) (deviceFlag, error) {
+	for _, df := range deviceFlags {
+		if df.Name == name {
+			return df, nil
+		}
+	}
+
+	return deviceFlag{}, fmt.Errorf("unknown device flag: %s", name)
+}
+
+// Returns whether the flags of a device flag status are enabled by name. Flags the inverter does not
+// report are left out.
+func flagStates(fl map[axpert.DeviceFlag]axpert.FlagStatus) map[string]bool {
+	states := make(map[string]bool, len(fl))
+	for _, df := range deviceFlags {
+		if status, ok := fl[df.Flag]; ok {
+			states[df.Name] = status == axpert.FlagEnabled
+		}
+	}
+
+	return states
+}
+
+// Retrieves the device flag status. The library parses NAK as a status without flags, which is
+// returned as errNotSupported.
+func readDeviceFlags(c connector.Connector) (map[axpert.DeviceFlag]axpert.FlagStatus, error) {
+	fl, err := axpert.DeviceFlagStatus(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(fl) == 0 {
+		return nil, errNotSupported
+	}
+
+	return fl, nil
+}
+
+// Parses the value of a flag, either 'on' or 'off'
+func parseFlagValue(v string) (bool, error) {
+	switch v {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	default:
+		return false, &ValidationError{Err: fmt.Errorf("flag value must be either on or off, not %s", v)}
+	}
+}
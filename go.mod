@@ -3,6 +3,8 @@ module github.com/marevers/axpert-gateway
 go 1.24.6
 
 require (
+	github.com/goburrow/serial v0.1.0
+	github.com/howeyc/crc16 v0.0.0-20171223171357-2b2a61e366a6
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/marevers/energia v0.1.0
 	github.com/prometheus/client_golang v1.23.0
@@ -12,8 +14,6 @@ require (
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
-	github.com/goburrow/serial v0.1.0 // indirect
-	github.com/howeyc/crc16 v0.0.0-20171223171357-2b2a61e366a6 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/prometheus/client_model v0.6.2 // indirect
 	github.com/prometheus/common v0.65.0 // indirect
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -13,8 +18,29 @@ var (
 	listenAddr     = flag.String("web.listen-address", ":8080", "The address to listen on for HTTP requests.")
 	metricsPath    = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
 	interval       = flag.Int("axpert.interval", 30, "Interval in seconds for data polling.")
+	schedule       = flag.String("axpert.schedule", "", "Comma-separated polling intervals per query group overriding axpert.interval, e.g. status=5s,rating=10m. Groups: status, parallel, rating, warnings, mode, outputmode, flags and energy, which is only polled if scheduled.")
 	metricsEnabled = flag.Bool("axpert.metrics", true, "Set to true to enable metrics collection.")
 	controlEnabled = flag.Bool("axpert.control", false, "Set to true to enable control API.")
+	serialDevices  = flag.String("axpert.serial-devices", "", "Comma-separated list of serial device paths (e.g. /dev/ttyUSB0) of inverters connected through RS232 or USB-serial.")
+	serialBaudRate = flag.Int("axpert.serial-baudrate", 2400, "Baud rate for serial devices.")
+	serialParity   = flag.String("axpert.serial-parity", "N", "Parity for serial devices - N: None, E: Even, O: Odd.")
+	tcpAddresses   = flag.String("axpert.tcp-addresses", "", "Comma-separated list of host:port addresses of inverters behind serial-to-TCP bridges.")
+	tcpTimeout     = flag.Duration("axpert.tcp-timeout", 5*time.Second, "Timeout for connecting to, reading from and writing to TCP bridges.")
+	simulate       = flag.Int("axpert.simulate", 0, "Number of simulated inverters to create instead of connecting to real devices.")
+	simStandby     = flag.Bool("axpert.simulate-standby", false, "Set to true to keep the simulated inverters in standby mode with their output switched off.")
+	rediscover     = flag.Duration("axpert.rediscover-interval", 30*time.Second, "Interval for reconnecting failing inverters and discovering new ones. Set to 0 to disable.")
+	maxFailures    = flag.Int("axpert.max-failures", 3, "Number of failed collection cycles in a row after which an inverter is reconnected.")
+	recordFile     = flag.String("axpert.record", "", "File to record all raw protocol traffic to.")
+	replayFile     = flag.String("axpert.replay", "", "File with recorded protocol traffic to replay instead of connecting to real devices.")
+
+	exchangeTimeout    = flag.Duration("axpert.timeout", 10*time.Second, "Deadline for a single request/response exchange with an inverter.")
+	retries            = flag.Int("axpert.retries", 2, "Number of times a failed exchange is retried.")
+	retryBackoff       = flag.Duration("axpert.retry-backoff", 500*time.Millisecond, "Backoff before the first retry, doubled for every further retry and jittered by up to 50%.")
+	breakerThreshold   = flag.Int("axpert.breaker-threshold", 5, "Number of failed exchanges in a row after which the circuit breaker of an inverter opens.")
+	breakerBackoff     = flag.Duration("axpert.breaker-backoff", 30*time.Second, "Time the circuit breaker stays open before a single exchange is let through to probe the inverter.")
+	breakerMaxBackoff  = flag.Duration("axpert.breaker-max-backoff", 10*time.Minute, "Maximum time the circuit breaker stays open, the backoff is doubled after every failed probe.")
+	energyState        = flag.String("axpert.energy-state", "", "File to persist the energy counters integrated by the gateway to, so they survive restarts.")
+	energySaveInterval = flag.Duration("axpert.energy-save-interval", time.Minute, "Interval for saving the energy counters to the state file.")
 )
 
 func main() {
@@ -26,6 +52,11 @@ func main() {
 		log.SetLevel(level)
 	}
 
+	sched, err := parseSchedule(*schedule, time.Duration(*interval)*time.Second)
+	if err != nil {
+		log.Fatalln("invalid polling schedule:", err)
+	}
+
 	app := &Application{
 		Prometheus: &Prometheus{
 			Reg: createRegistry(),
@@ -33,14 +64,54 @@ func main() {
 	}
 	app.Prometheus.RegisterMetrics()
 
-	log.Infoln("Initialising inverters connected through USB")
-	invs, err := initInverters()
+	energy, err := NewEnergyMeter(*energyState)
+	if err != nil {
+		log.Fatalln("failed to load energy state:", err)
+	}
+	app.Energy = energy
+	if *energyState != "" {
+		go energy.saveEvery(*energySaveInterval)
+	}
+
+	var rec *Recorder
+	if *recordFile != "" {
+		r, err := NewRecorder(*recordFile)
+		if err != nil {
+			log.Fatalln("failed to open recording file:", err)
+		}
+		defer r.Close()
+
+		log.Infoln("Recording protocol traffic to:", *recordFile)
+		rec = r
+	}
+
+	switch {
+	case *simulate > 0:
+		log.Infof("Simulating %d inverters", *simulate)
+	case *replayFile != "":
+		log.Infoln("Replaying protocol traffic from:", *replayFile)
+	default:
+		log.Infoln("Initialising inverters connected through USB, serial and TCP")
+	}
+	invs, err := initInverters(rec)
 	if err != nil {
 		log.Fatalln("failed to initialise inverters:", err)
 	}
 	app.Inverters = invs
-	for _, inv := range app.Inverters {
-		defer inv.Connector.Close()
+	app.Recorder = rec
+	defer func() {
+		// Connectors may have been replaced or dropped while running
+		for _, inv := range app.inverterList() {
+			inv.mu.Lock()
+			if inv.Connector != nil {
+				inv.closeConnector()
+			}
+			inv.mu.Unlock()
+		}
+	}()
+
+	if *rediscover > 0 && *simulate == 0 && *replayFile == "" {
+		go app.superviseInverters(*rediscover)
 	}
 
 	srv := &http.Server{
@@ -49,14 +120,28 @@ func main() {
 	}
 
 	if *metricsEnabled {
-		go func() {
-			startMetricsCollection(app, time.Duration(*interval)*time.Second)
-		}()
+		startMetricsCollection(app, sched)
 	}
 
+	// Shut down gracefully, so connectors are closed and the energy state is saved
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		log.Infoln("Shutting down axpert-gateway")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
 	log.Infoln("Starting axpert-gateway at:", *listenAddr)
 	err = srv.ListenAndServe()
-	if err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalln("error starting HTTP server:", err)
 	}
+
+	if err := energy.Save(); err != nil {
+		log.Errorln("failed to save energy state:", err)
+	}
 }
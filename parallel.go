@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/marevers/energia/pkg/axpert"
+	"github.com/marevers/energia/pkg/connector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Highest parallel index that can be queried (QPGS0 to QPGS9)
+const maxParallelIndex = 9
+
+const (
+	// LabelParallelID represents the index of a unit in a parallel cluster
+	LabelParallelID = "parallel_id"
+
+	// LabelPhase represents the output phase of a unit in a parallel cluster, empty for single-phase output
+	LabelPhase = "phase"
+
+	// LabelReportedBy represents the serial number of the inverter a unit of a parallel cluster was queried from
+	LabelReportedBy = "reported_by"
+)
+
+// Parallel unit labels come with every per-unit metric of a parallel cluster. The serial number is the
+// one of the unit itself, the inverter it was queried from is in the reported_by label, so units
+// reported by several inverters of the same cluster do not overwrite each other.
+var parallelUnitLabels = []string{
+	LabelSerialNumber,
+	LabelParallelID,
+	LabelPhase,
+	LabelReportedBy,
+}
+
+// Represents a metric exported for every unit of a parallel cluster
+type parallelUnitMetric struct {
+	Name  string
+	Help  string
+	Value func(pi *axpert.ParallelInfo) float64
+}
+
+// Metrics exported for every unit of a parallel cluster
+var parallelUnitMetrics = []parallelUnitMetric{
+	{"devicemode", "Shows the device mode of the unit - 0: PowerOnMode, 1: StandbyMode, 2: LineMode, 3: BatteryMode, 4: FaultMode, 5: PowerSavingMode",
+		unitDeviceMode},
+	{"fault_code", "Fault code of the unit, 0 if there is no fault",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.FaultCode) }},
+	{"grid_voltage", "Grid voltage of the unit in volts",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.GridVoltage) }},
+	{"grid_frequency", "Grid frequency of the unit in herz",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.GridFrequency) }},
+	{"acoutput_voltage", "AC output voltage of the unit in volts",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.ACOutputVoltage) }},
+	{"acoutput_frequency", "AC output frequency of the unit in herz",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.ACOutputFrequency) }},
+	{"acoutput_apparent_power", "AC output apparent power of the unit in volt-amperes",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.ACOutputApparentPower) }},
+	{"acoutput_active_power", "AC output active power of the unit in watts",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.ACOutputActivePower) }},
+	{"output_load_percent", "Output load of the unit in percent",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.OutputLoadPercent) }},
+	{"battery_voltage", "Battery voltage seen by the unit in volts",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.BatteryVoltage) }},
+	{"battery_capacity", "Battery capacity seen by the unit in percent",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.BatteryCapacity) }},
+	{"battery_charge_current", "Battery charge current of the unit in amperes",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.BatteryChargingCurrent) }},
+	{"battery_discharge_current", "Battery discharge current of the unit in amperes",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.BatteryDischargeCurrent) }},
+	{"battery_status", "Shows the battery status seen by the unit - 0: Normal, 1: Under, 2: Open",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.BatteryStatus) }},
+	{"pvinput_voltage", "PV input voltage of the unit in volts",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.PV1InputVoltage) }},
+	{"pvinput_current", "PV input current of the unit in amperes",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.PV1InputCurrent) }},
+	{"pvinput_power", "PV input power of the unit in watts, derived from voltage and current",
+		func(pi *axpert.ParallelInfo) float64 {
+			return float64(pi.PV1InputVoltage) * float64(pi.PV1InputCurrent)
+		}},
+	{"charger_sourcepriority", "Shows the charger source priority of the unit - 0: Utility first, 1: Solar first, 2: Solar and utility, 3: Solar only",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.ChargerSourcePriority) }},
+	{"charger_maxtotalcurrent", "Maximum total charge current of the unit in amperes",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.MaxChargerCurrent) }},
+	{"charger_maxcurrent", "Maximum AC charge current of the unit in amperes",
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.MaxACChargerCurrent) }},
+	{"outputmode", "Shows the output mode of the unit - " + outputModeHelp,
+		func(pi *axpert.ParallelInfo) float64 { return float64(pi.OutputMode) }},
+	{"acchargeon", "Returns 1 if the unit charges the battery with utility power",
+		func(pi *axpert.ParallelInfo) float64 { return convertBoolToFloat(pi.ACCharging) }},
+	{"lineloss", "Returns 1 if the utility line of the unit is offline",
+		func(pi *axpert.ParallelInfo) float64 { return convertBoolToFloat(pi.LineLoss) }},
+	{"loadon", "Returns 1 if the output of the unit has load",
+		func(pi *axpert.ParallelInfo) float64 { return convertBoolToFloat(pi.LoadOn) }},
+	{"scc_ok", "Returns 1 if the solar charge controller of the unit is working",
+		func(pi *axpert.ParallelInfo) float64 { return convertBoolToFloat(pi.SCC1OK) }},
+}
+
+// Returns the device mode of a unit, units reporting an unknown mode are exported as -1
+func unitDeviceMode(pi *axpert.ParallelInfo) float64 {
+	mode, err := parseDeviceMode(pi.DeviceMode)
+	if err != nil {
+		return -1
+	}
+
+	return mode
+}
+
+// Registers the per-unit metrics of parallel clusters, in the order of parallelUnitMetrics
+func (p *Prometheus) registerParallelUnitMetrics() {
+	p.Metrics.ParallelUnitVecs = make([]*prometheus.GaugeVec, len(parallelUnitMetrics))
+
+	for i, m := range parallelUnitMetrics {
+		p.Metrics.ParallelUnitVecs[i] = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name:      "parallel_" + m.Name,
+			Namespace: Namespace,
+			Help:      m.Help,
+		}, parallelUnitLabels)
+	}
+}
+
+// Returns the output phase of a unit in a parallel cluster, empty for single-phase output
+func mapPhase(om axpert.OutputMode) string {
+	switch om {
+	case axpert.Phase1, outputSplitPhase1:
+		return "1"
+	case axpert.Phase2, outputSplitPhase2120, outputSplitPhase2180:
+		return "2"
+	case axpert.Phase3:
+		return "3"
+	default:
+		return ""
+	}
+}
+
+// Returns the number of parallel indices to query. Single machines and inverters whose rating
+// information has not been retrieved yet are only queried for the first index.
+func parallelUnitCount(cs *CurrentSettings) int {
+	if cs == nil || cs.OutputMode == "" || cs.OutputMode == mapOutputMode(axpert.SingleMachine) {
+		return 1
+	}
+
+	return min(max(cs.ParallelMaxNumber, 1), maxParallelIndex+1)
+}
+
+// Retrieves the parallel device information (QPGS) of every unit in the cluster. Units are queried
+// up to the parallel max number and the query stops at the first index without a unit.
+func (a *Application) collectParallelInfo(inv *Inverter, c *exchangeConnector, labelValues []string) error {
+	var first *axpert.ParallelInfo
+	var units []*axpert.ParallelInfo
+
+	// Number of parallel indices that were queried, lower than n if a query failed
+	n := parallelUnitCount(inv.CurrentSettings)
+	queried := n
+
+	for idx := 0; idx < n; idx++ {
+		pi, err := observe(c, fmt.Sprintf("QPGS%d", idx), func(c connector.Connector) (*axpert.ParallelInfo, error) {
+			return axpert.ParallelDeviceInfo(c, idx)
+		})
+		if err != nil {
+			if idx == 0 {
+				return fmt.Errorf("failed to retrieve parallel device info: %w", err)
+			}
+			// Keep the units that were retrieved, the cluster totals are reported by every unit
+			log.Errorf("failed to retrieve parallel device info of unit %d from device with serialno '%s': %s", idx, inv.SerialNo, err)
+			queried = idx
+			break
+		}
+
+		log.Debugf("parallel device information of unit %d:", idx)
+		log.Debugf("%+v", pi)
+
+		if idx == 0 {
+			first = pi
+		}
+		if !pi.DeviceExists {
+			break
+		}
+		units = append(units, pi)
+	}
+
+	// The inverter's own unit is found by its serial number, the first index is used if it is not part
+	// of a cluster
+	self := first
+	for _, pi := range units {
+		if pi.SerialNumber == inv.SerialNo {
+			self = pi
+			break
+		}
+	}
+
+	if err := inv.UpdateCurrentSettings(self); err != nil {
+		log.Errorf("failed to update current settings for device with serialno '%s': %s", inv.SerialNo, err)
+	}
+
+	a.Prometheus.Metrics.LoadOnVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(self.LoadOn))
+	a.Prometheus.Metrics.LineLossVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(self.LineLoss))
+	a.Prometheus.Metrics.ACChargeOnVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(self.ACCharging))
+
+	a.exportParallelUnits(inv, units, queried)
+
+	return nil
+}
+
+// Exports the status of the units of a parallel cluster and the cluster totals. Series of units that
+// left the cluster or changed their parallel index or phase are removed. Units at parallel indices from
+// queried on were not queried because a query failed, so their series are kept until the next cycle.
+func (a *Application) exportParallelUnits(inv *Inverter, units []*axpert.ParallelInfo, queried int) {
+	current := make(map[string]prometheus.Labels, len(units))
+	for _, pi := range units {
+		current[pi.SerialNumber] = prometheus.Labels{
+			LabelSerialNumber: pi.SerialNumber,
+			LabelParallelID:   strconv.Itoa(pi.DeviceIndex),
+			LabelPhase:        mapPhase(pi.OutputMode),
+			LabelReportedBy:   inv.SerialNo,
+		}
+	}
+
+	for sn, l := range inv.parallelUnits {
+		if _, ok := current[sn]; ok {
+			continue
+		}
+		if id, err := strconv.Atoi(l[LabelParallelID]); err == nil && id >= queried {
+			current[sn] = l
+		}
+	}
+
+	for sn, l := range inv.parallelUnits {
+		if cl, ok := current[sn]; ok && cl[LabelParallelID] == l[LabelParallelID] && cl[LabelPhase] == l[LabelPhase] {
+			continue
+		}
+		for _, vec := range a.Prometheus.Metrics.ParallelUnitVecs {
+			vec.Delete(l)
+		}
+	}
+	inv.parallelUnits = current
+
+	for _, pi := range units {
+		a.exportParallelUnit(current[pi.SerialNumber], pi)
+	}
+
+	m := &a.Prometheus.Metrics
+	clusterVecs := []*prometheus.GaugeVec{m.ClusterUnitsVec, m.ClusterOutputApparentVec, m.ClusterOutputActiveVec, m.ClusterOutputLoadVec, m.ClusterChgCurrentVec}
+
+	if len(units) == 0 {
+		for _, vec := range clusterVecs {
+			vec.DeleteLabelValues(inv.SerialNo)
+		}
+		return
+	}
+
+	// Every unit reports the totals of the whole cluster
+	total := units[0]
+
+	a.Prometheus.Metrics.ClusterUnitsVec.WithLabelValues(inv.SerialNo).Set(float64(len(current)))
+	a.Prometheus.Metrics.ClusterOutputApparentVec.WithLabelValues(inv.SerialNo).Set(float64(total.TotalACOutputApparentPower))
+	a.Prometheus.Metrics.ClusterOutputActiveVec.WithLabelValues(inv.SerialNo).Set(float64(total.TotalOutputActivePower))
+	a.Prometheus.Metrics.ClusterOutputLoadVec.WithLabelValues(inv.SerialNo).Set(float64(total.TotalACOutputPercent))
+	a.Prometheus.Metrics.ClusterChgCurrentVec.WithLabelValues(inv.SerialNo).Set(float64(total.TotalChargingCurrent))
+}
+
+// Exports the status of a single unit of a parallel cluster
+func (a *Application) exportParallelUnit(l prometheus.Labels, pi *axpert.ParallelInfo) {
+	for i, m := range parallelUnitMetrics {
+		a.Prometheus.Metrics.ParallelUnitVecs[i].With(l).Set(m.Value(pi))
+	}
+}
+
+// Returns the parallel index of the inverter itself, 0 if it is not part of a cluster
+func (inv *Inverter) parallelID() int {
+	if l, ok := inv.parallelUnits[inv.SerialNo]; ok {
+		if id, err := strconv.Atoi(l[LabelParallelID]); err == nil {
+			return id
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/marevers/energia/pkg/axpert"
+)
+
+// Returns the number of series of the metric with the given name
+func countSeries(t *testing.T, app *Application, name string) int {
+	t.Helper()
+
+	families, err := app.Prometheus.Reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return len(mf.GetMetric())
+		}
+	}
+
+	return 0
+}
+
+// Returns the parallel information of a unit of a cluster
+func testUnit(idx int, sn string) *axpert.ParallelInfo {
+	return &axpert.ParallelInfo{DeviceIndex: idx, DeviceExists: true, SerialNumber: sn, OutputMode: axpert.Phase1}
+}
+
+func TestExportParallelUnits(t *testing.T) {
+	app := &Application{Prometheus: &Prometheus{Reg: createRegistry()}}
+	app.Prometheus.RegisterMetrics()
+	inv := &Inverter{SerialNo: "92400000000000"}
+
+	units := []*axpert.ParallelInfo{
+		testUnit(0, "92400000000000"),
+		testUnit(1, "92400000000001"),
+		testUnit(2, "92400000000002"),
+	}
+
+	app.exportParallelUnits(inv, units, 3)
+	if n := countSeries(t, app, "axpert_parallel_loadon"); n != 3 {
+		t.Fatalf("got %d unit series, want 3", n)
+	}
+
+	// A failed query of unit 1 keeps the series of the units that were not queried
+	app.exportParallelUnits(inv, units[:1], 1)
+	if n := countSeries(t, app, "axpert_parallel_loadon"); n != 3 {
+		t.Errorf("got %d unit series after a failed query, want 3", n)
+	}
+	if len(inv.parallelUnits) != 3 {
+		t.Errorf("got %d units after a failed query, want 3", len(inv.parallelUnits))
+	}
+
+	// A unit that left the cluster is removed once all units were queried
+	app.exportParallelUnits(inv, units[:2], 3)
+	if n := countSeries(t, app, "axpert_parallel_loadon"); n != 2 {
+		t.Errorf("got %d unit series after a unit left, want 2", n)
+	}
+
+	// Without units, the cluster totals are removed as well
+	app.exportParallelUnits(inv, nil, 3)
+	if n := countSeries(t, app, "axpert_parallel_loadon"); n != 0 {
+		t.Errorf("got %d unit series without units, want 0", n)
+	}
+	if n := countSeries(t, app, "axpert_cluster_units"); n != 0 {
+		t.Errorf("got %d cluster series without units, want 0", n)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Starts polling all inverters using the given interval per query group. Every inverter is polled by
+// its own goroutine, so a slow or hung device only delays itself. Inverters added later are polled as
+// they are added.
+func startMetricsCollection(a *Application, schedule map[string]time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.schedule = schedule
+	for _, inv := range a.Inverters {
+		go a.pollInverter(inv, schedule)
+	}
+}
+
+// Polls a single inverter. Every query group is polled at its own interval; groups that are due at
+// the same time are polled in a single cycle.
+func (a *Application) pollInverter(inv *Inverter, schedule map[string]time.Duration) {
+	next := make(map[string]time.Time, len(queryGroups))
+
+	inv.mu.Lock()
+	a.exportIdentity(inv)
+	inv.mu.Unlock()
+
+	for {
+		now := time.Now()
+
+		var due []queryGroup
+		for _, g := range queryGroups {
+			if _, scheduled := schedule[g.Name]; !scheduled {
+				continue
+			}
+			if !next[g.Name].After(now) {
+				due = append(due, g)
+			}
+		}
+
+		if len(due) > 0 {
+			a.CalculateMetrics(inv, due)
+			log.Debugf("Metrics retrieval of %d query groups from device with serialno '%s' took %s", len(due), inv.SerialNo, time.Since(now))
+
+			a.updateScrapeError()
+
+			// Keep groups in phase, so groups with related intervals stay in the same cycle,
+			// but skip cycles that were missed because a device was slow
+			for _, g := range due {
+				t := next[g.Name].Add(schedule[g.Name])
+				if next[g.Name].IsZero() || t.Before(now) {
+					t = now.Add(schedule[g.Name])
+				}
+				next[g.Name] = t
+			}
+		}
+
+		// Sleep until the next query group is due
+		wake := time.Time{}
+		for _, t := range next {
+			if wake.IsZero() || t.Before(wake) {
+				wake = t
+			}
+		}
+		time.Sleep(time.Until(wake))
+	}
+}
+
+// Parses a schedule of comma-separated group=interval pairs (e.g. "status=5s,rating=10m").
+// Query groups that are not in the schedule are polled at the default interval, except for optional
+// groups, which are left out of the returned schedule.
+func parseSchedule(s string, def time.Duration) (map[string]time.Duration, error) {
+	known := make(map[string]bool, len(queryGroups))
+	schedule := make(map[string]time.Duration, len(queryGroups))
+	for _, g := range queryGroups {
+		known[g.Name] = true
+		if !g.Optional {
+			schedule[g.Name] = def
+		}
+	}
+
+	for _, item := range splitList(s) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule entry '%s', expected group=interval", item)
+		}
+
+		name = strings.TrimSpace(name)
+		if !known[name] {
+			return nil, fmt.Errorf("unknown query group '%s'", name)
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval for query group '%s': %w", name, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("interval for query group '%s' must be positive", name)
+		}
+
+		schedule[name] = d
+	}
+
+	return schedule, nil
+}
+
+// Sets the scrape error metric if the last cycle of any inverter failed. The inverter locks are not
+// taken, so a slow cycle of one inverter does not delay the polling of the others.
+func (a *Application) updateScrapeError() {
+	scrapeErr := false
+
+	for _, inv := range a.inverterList() {
+		if inv.scrapeErr.Load() {
+			scrapeErr = true
+		}
+	}
+
+	a.Prometheus.Metrics.ScrapeError.Set(convertBoolToFloat(scrapeErr))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	def := 30 * time.Second
+
+	// Returns the default schedule with the given intervals changed
+	schedule := func(changes map[string]time.Duration) map[string]time.Duration {
+		s := map[string]time.Duration{
+			"status": def, "rating": def, "warnings": def, "mode": def,
+			"outputmode": def, "parallel": def, "flags": def,
+		}
+		maps.Copy(s, changes)
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]time.Duration
+		wantErr string
+	}{
+		{name: "default", want: schedule(nil)},
+		{
+			name:  "intervals per group",
+			value: "status=5s,rating=10m",
+			want:  schedule(map[string]time.Duration{"status": 5 * time.Second, "rating": 10 * time.Minute}),
+		},
+		{
+			name:  "whitespace",
+			value: " status = 5s , warnings=1m ",
+			want:  schedule(map[string]time.Duration{"status": 5 * time.Second, "warnings": time.Minute}),
+		},
+		{
+			name:  "optional group",
+			value: "energy=15m",
+			want:  schedule(map[string]time.Duration{"energy": 15 * time.Minute}),
+		},
+		{name: "unknown group", value: "status=5s,battery=1m", wantErr: "unknown query group 'battery'"},
+		{name: "missing interval", value: "status", wantErr: "invalid schedule entry 'status'"},
+		{name: "invalid interval", value: "status=often", wantErr: "invalid interval for query group 'status'"},
+		{name: "interval without unit", value: "status=5", wantErr: "invalid interval for query group 'status'"},
+		{name: "zero interval", value: "rating=0s", wantErr: "interval for query group 'rating' must be positive"},
+		{name: "negative interval", value: "rating=-1m", wantErr: "interval for query group 'rating' must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSchedule(tt.value, def)
+			checkErr(t, err, tt.wantErr)
+
+			if tt.wantErr == "" && !maps.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
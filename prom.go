@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/marevers/energia/pkg/axpert"
@@ -71,10 +73,160 @@ func mapChargerSourcePriority(priority axpert.ChargerSourcePriority) string {
 	}
 }
 
+// Lithium battery type of newer protocols that is not defined by energia
+const batteryLithium axpert.BatteryType = 3
+
+// mapBatteryType converts axpert battery type to string, unknown types are returned as their number
+func mapBatteryType(bt axpert.BatteryType) string {
+	switch bt {
+	case axpert.AGM:
+		return "agm"
+	case axpert.Flooded:
+		return "flooded"
+	case axpert.User:
+		return "user"
+	case batteryLithium:
+		return "lithium"
+	default:
+		return strconv.Itoa(int(bt))
+	}
+}
+
+// mapInputVoltageRange converts axpert input voltage range to string
+func mapInputVoltageRange(vr axpert.VoltageRange) string {
+	switch vr {
+	case axpert.Appliance:
+		return "appliance"
+	case axpert.UPS:
+		return "ups"
+	default:
+		return strconv.Itoa(int(vr))
+	}
+}
+
+// mapMachineType converts axpert machine type to string
+func mapMachineType(mt axpert.MachineType) string {
+	switch mt {
+	case axpert.GridTie:
+		return "gridtie"
+	case axpert.OffGrid:
+		return "offgrid"
+	case axpert.Hybrid:
+		return "hybrid"
+	case axpert.OffGrid2Trackers:
+		return "offgrid2trackers"
+	case axpert.OffGrid3Trackers:
+		return "offgrid3trackers"
+	default:
+		return strconv.Itoa(int(mt))
+	}
+}
+
+// mapTopology converts axpert topology to string
+func mapTopology(t axpert.Topology) string {
+	switch t {
+	case axpert.Transfomerless:
+		return "transformerless"
+	case axpert.Transformer:
+		return "transformer"
+	default:
+		return strconv.Itoa(int(t))
+	}
+}
+
+// Output modes of newer protocols that are not defined by energia
+const (
+	outputSplitPhase1    axpert.OutputMode = 5
+	outputSplitPhase2120 axpert.OutputMode = 6
+	outputSplitPhase2180 axpert.OutputMode = 7
+)
+
+// Output modes in the order of their numeric value
+var outputModes = []axpert.OutputMode{
+	axpert.SingleMachine,
+	axpert.Parallel,
+	axpert.Phase1,
+	axpert.Phase2,
+	axpert.Phase3,
+	outputSplitPhase1,
+	outputSplitPhase2120,
+	outputSplitPhase2180,
+}
+
+// Device modes as reported by the inverter, in the order of their numeric value
+var deviceModes = []string{"P", "S", "L", "B", "F", "H"}
+
+// mapOutputMode converts axpert output mode to string
+func mapOutputMode(om axpert.OutputMode) string {
+	switch om {
+	case axpert.SingleMachine:
+		return "single"
+	case axpert.Parallel:
+		return "parallel"
+	case axpert.Phase1: // Phase 1 of 3-phase output
+		return "phase1"
+	case axpert.Phase2: // Phase 2 of 3-phase output
+		return "phase2"
+	case axpert.Phase3: // Phase 3 of 3-phase output
+		return "phase3"
+	case outputSplitPhase1: // Phase 1 of 2-phase output
+		return "splitphase1"
+	case outputSplitPhase2120: // Phase 2 of 2-phase output, 120° from phase 1
+		return "splitphase2_120"
+	case outputSplitPhase2180: // Phase 2 of 2-phase output, 180° from phase 1
+		return "splitphase2_180"
+	default:
+		return strconv.Itoa(int(om))
+	}
+}
+
+// mapParallelPVOK converts axpert parallel PV setting to string
+func mapParallelPVOK(pv axpert.ParallelPVOK) string {
+	switch pv {
+	case axpert.AnyInverterConnected:
+		return "any"
+	case axpert.AllInvertersConnected:
+		return "all"
+	default:
+		return strconv.Itoa(int(pv))
+	}
+}
+
+// mapPVPowerBalance converts axpert PV power balance setting to string
+func mapPVPowerBalance(pb axpert.PVPowerBalance) string {
+	switch pb {
+	case axpert.InputCurrentIsChargedCurrent:
+		return "chargecurrent"
+	case axpert.InputPowerIsChargedPowerPlusLoadPower:
+		return "chargepowerplusload"
+	default:
+		return strconv.Itoa(int(pb))
+	}
+}
+
+// Describes the numeric values of the output mode
+const outputModeHelp = "0: SingleMachine, 1: Parallel, 2: Phase 1 of 3-phase, 3: Phase 2 of 3-phase, 4: Phase 3 of 3-phase, " +
+	"5: Phase 1 of 2-phase, 6: Phase 2 of 2-phase (120°), 7: Phase 2 of 2-phase (180°)"
+
 const (
 	// LabelSerialNumber represents the inverter serial number
 	LabelSerialNumber = "serialno"
 
+	// LabelQuery represents the protocol query
+	LabelQuery = "query"
+
+	// LabelErrorClass represents the class of a failed query
+	LabelErrorClass = "class"
+
+	// LabelWarning represents the name of a warning
+	LabelWarning = "warning"
+
+	// LabelSeverity represents the severity of a warning - fault or warning
+	LabelSeverity = "severity"
+
+	// LabelFlag represents the name of a device flag
+	LabelFlag = "flag"
+
 	// Namespace is the metrics prefix
 	Namespace = "axpert"
 )
@@ -84,6 +236,23 @@ var (
 	labels = []string{
 		LabelSerialNumber,
 	}
+
+	// Rating info labels come with the rating info metric
+	ratingInfoLabels = []string{
+		"battery_type",
+		"input_voltage_range",
+		"machine_type",
+		"topology",
+		"output_mode",
+		"parallel_pv_ok",
+		"pv_power_balance",
+	}
+
+	// Query labels come with every query health metric
+	queryLabels = []string{
+		LabelSerialNumber,
+		LabelQuery,
+	}
 )
 
 type Prometheus struct {
@@ -118,11 +287,35 @@ type Prometheus struct {
 		SCCChargeOn2Vec *prometheus.GaugeVec
 		SCCChargeOn3Vec *prometheus.GaugeVec
 
+		// Derived power
+		PvInputPower1Vec        *prometheus.GaugeVec
+		PvInputPower2Vec        *prometheus.GaugeVec
+		PvInputPower3Vec        *prometheus.GaugeVec
+		PvPowerVec              *prometheus.GaugeVec
+		BatPowerVec             *prometheus.GaugeVec
+		GridImportPowerVec      *prometheus.GaugeVec
+		SelfConsumptionRatioVec *prometheus.GaugeVec
+
+		// Derived energy
+		PvEnergyVec         *prometheus.CounterVec
+		BatChgEnergyVec     *prometheus.CounterVec
+		BatDischgEnergyVec  *prometheus.CounterVec
+		LoadEnergyVec       *prometheus.CounterVec
+		GridImportEnergyVec *prometheus.CounterVec
+
 		// Parallel device information
 		LineLossVec   *prometheus.GaugeVec
 		LoadOnVec     *prometheus.GaugeVec
 		ACChargeOnVec *prometheus.GaugeVec
 
+		// Parallel cluster
+		ParallelUnitVecs         []*prometheus.GaugeVec
+		ClusterUnitsVec          *prometheus.GaugeVec
+		ClusterOutputApparentVec *prometheus.GaugeVec
+		ClusterOutputActiveVec   *prometheus.GaugeVec
+		ClusterOutputLoadVec     *prometheus.GaugeVec
+		ClusterChgCurrentVec     *prometheus.GaugeVec
+
 		// Rating information
 		OutputSourcePrioVec       *prometheus.GaugeVec
 		ChargerSourcePrioVec      *prometheus.GaugeVec
@@ -131,18 +324,52 @@ type Prometheus struct {
 		BatteryRedischgVoltageVec *prometheus.GaugeVec
 		BatteryUnderVoltageVec    *prometheus.GaugeVec
 		BatteryFloatVoltageVec    *prometheus.GaugeVec
+		BatteryBulkVoltageVec     *prometheus.GaugeVec
+		BatteryRatingVoltageVec   *prometheus.GaugeVec
+		MaxChargerCurrentVec      *prometheus.GaugeVec
+		GridRatingVoltageVec      *prometheus.GaugeVec
+		GridRatingCurrentVec      *prometheus.GaugeVec
+		AcOutputRatingVoltageVec  *prometheus.GaugeVec
+		AcOutputRatingFreqVec     *prometheus.GaugeVec
+		AcOutputRatingCurrentVec  *prometheus.GaugeVec
+		AcOutputRatingApparentVec *prometheus.GaugeVec
+		AcOutputRatingActiveVec   *prometheus.GaugeVec
+		ParallelMaxNumberVec      *prometheus.GaugeVec
+		RatingInfoVec             *prometheus.GaugeVec
+		BatteryTypeInfoVec        *prometheus.GaugeVec
 
 		// Statuses
 		OverloadVec *prometheus.GaugeVec
+		WarningVec  *prometheus.GaugeVec
+
+		// Device flags
+		FlagVec *prometheus.GaugeVec
 
 		// Device mode
-		DeviceModeVec *prometheus.GaugeVec
+		DeviceModeVec      *prometheus.GaugeVec
+		DeviceModeStateVec *prometheus.GaugeVec
 
 		// Output mode
-		OutputModeVec *prometheus.GaugeVec
+		OutputModeVec      *prometheus.GaugeVec
+		OutputModeStateVec *prometheus.GaugeVec
 
 		// Scrape error
 		ScrapeError prometheus.Gauge
+
+		// Energy counters of the inverter firmware
+		EnergyCounters *EnergyCounterCollector
+
+		// Circuit breaker
+		CircuitBreakerStateVec *prometheus.GaugeVec
+
+		// Identity
+		InverterInfoVec *prometheus.GaugeVec
+
+		// Query health
+		QueryLastSuccessVec         *prometheus.GaugeVec
+		QueryConsecutiveFailuresVec *prometheus.GaugeVec
+		QueryErrorsVec              *prometheus.CounterVec
+		QueryDurationVec            *prometheus.HistogramVec
 	}
 }
 
@@ -292,6 +519,82 @@ func (p *Prometheus) RegisterMetrics() {
 		Help:      "Returns 1 if battery is being charged with solar power 3",
 	}, labels)
 
+	// Derived power
+
+	p.Metrics.PvInputPower1Vec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "pvinput1_power",
+		Namespace: Namespace,
+		Help:      "PV input 1 power in watts, computed from voltage and current",
+	}, labels)
+
+	p.Metrics.PvInputPower2Vec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "pvinput2_power",
+		Namespace: Namespace,
+		Help:      "PV input 2 power in watts, computed from voltage and current",
+	}, labels)
+
+	p.Metrics.PvInputPower3Vec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "pvinput3_power",
+		Namespace: Namespace,
+		Help:      "PV input 3 power in watts, computed from voltage and current",
+	}, labels)
+
+	p.Metrics.PvPowerVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "pv_power",
+		Namespace: Namespace,
+		Help:      "Total PV power of all inputs in watts",
+	}, labels)
+
+	p.Metrics.BatPowerVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "battery_power",
+		Namespace: Namespace,
+		Help:      "Net battery power in watts, positive while charging and negative while discharging",
+	}, labels)
+
+	p.Metrics.GridImportPowerVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "grid_import_power",
+		Namespace: Namespace,
+		Help:      "Estimated power drawn from the grid in watts, ignoring conversion losses",
+	}, labels)
+
+	p.Metrics.SelfConsumptionRatioVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "self_consumption_ratio",
+		Namespace: Namespace,
+		Help:      "Share of the load supplied by PV and battery instead of the grid, from 0 to 1",
+	}, labels)
+
+	// Derived energy
+
+	p.Metrics.PvEnergyVec = promauto.With(p.Reg).NewCounterVec(prometheus.CounterOpts{
+		Name:      "pv_energy_kwh_total",
+		Namespace: Namespace,
+		Help:      "PV energy produced in kWh, integrated by the gateway",
+	}, labels)
+
+	p.Metrics.BatChgEnergyVec = promauto.With(p.Reg).NewCounterVec(prometheus.CounterOpts{
+		Name:      "battery_charge_energy_kwh_total",
+		Namespace: Namespace,
+		Help:      "Energy charged into the battery in kWh, integrated by the gateway",
+	}, labels)
+
+	p.Metrics.BatDischgEnergyVec = promauto.With(p.Reg).NewCounterVec(prometheus.CounterOpts{
+		Name:      "battery_discharge_energy_kwh_total",
+		Namespace: Namespace,
+		Help:      "Energy discharged from the battery in kWh, integrated by the gateway",
+	}, labels)
+
+	p.Metrics.LoadEnergyVec = promauto.With(p.Reg).NewCounterVec(prometheus.CounterOpts{
+		Name:      "load_energy_kwh_total",
+		Namespace: Namespace,
+		Help:      "Energy consumed by the load in kWh, integrated by the gateway",
+	}, labels)
+
+	p.Metrics.GridImportEnergyVec = promauto.With(p.Reg).NewCounterVec(prometheus.CounterOpts{
+		Name:      "grid_import_energy_kwh_total",
+		Namespace: Namespace,
+		Help:      "Estimated energy drawn from the grid in kWh, integrated by the gateway",
+	}, labels)
+
 	// Parallel device information
 
 	p.Metrics.LineLossVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
@@ -312,6 +615,40 @@ func (p *Prometheus) RegisterMetrics() {
 		Help:      "Returns 1 if battery is being charged with utility power",
 	}, labels)
 
+	// Parallel cluster
+
+	p.registerParallelUnitMetrics()
+
+	p.Metrics.ClusterUnitsVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "cluster_units",
+		Namespace: Namespace,
+		Help:      "Number of units in the parallel cluster of the inverter",
+	}, labels)
+
+	p.Metrics.ClusterOutputApparentVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "cluster_output_apparent_power",
+		Namespace: Namespace,
+		Help:      "Total AC output apparent power of the parallel cluster in volt-amperes",
+	}, labels)
+
+	p.Metrics.ClusterOutputActiveVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "cluster_output_active_power",
+		Namespace: Namespace,
+		Help:      "Total AC output active power of the parallel cluster in watts",
+	}, labels)
+
+	p.Metrics.ClusterOutputLoadVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "cluster_output_load_percent",
+		Namespace: Namespace,
+		Help:      "Total output load of the parallel cluster in percent",
+	}, labels)
+
+	p.Metrics.ClusterChgCurrentVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "cluster_battery_charge_current",
+		Namespace: Namespace,
+		Help:      "Total battery charge current of the parallel cluster in amperes",
+	}, labels)
+
 	// Rating info
 
 	p.Metrics.OutputSourcePrioVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
@@ -356,6 +693,84 @@ func (p *Prometheus) RegisterMetrics() {
 		Help:      "Battery float voltage",
 	}, labels)
 
+	p.Metrics.BatteryBulkVoltageVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "battery_bulk_voltage",
+		Namespace: Namespace,
+		Help:      "Battery bulk / constant voltage charging voltage",
+	}, labels)
+
+	p.Metrics.BatteryRatingVoltageVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "battery_rating_voltage",
+		Namespace: Namespace,
+		Help:      "Battery rating voltage",
+	}, labels)
+
+	p.Metrics.MaxChargerCurrentVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "charger_maxtotalcurrent",
+		Namespace: Namespace,
+		Help:      "Max total (solar and utility) charging current in amps",
+	}, labels)
+
+	p.Metrics.GridRatingVoltageVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "grid_rating_voltage",
+		Namespace: Namespace,
+		Help:      "Grid rating voltage",
+	}, labels)
+
+	p.Metrics.GridRatingCurrentVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "grid_rating_current",
+		Namespace: Namespace,
+		Help:      "Grid rating current in amps",
+	}, labels)
+
+	p.Metrics.AcOutputRatingVoltageVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "acoutput_rating_voltage",
+		Namespace: Namespace,
+		Help:      "AC output rating voltage",
+	}, labels)
+
+	p.Metrics.AcOutputRatingFreqVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "acoutput_rating_frequency",
+		Namespace: Namespace,
+		Help:      "AC output rating frequency in herz",
+	}, labels)
+
+	p.Metrics.AcOutputRatingCurrentVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "acoutput_rating_current",
+		Namespace: Namespace,
+		Help:      "AC output rating current in amps",
+	}, labels)
+
+	p.Metrics.AcOutputRatingApparentVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "acoutput_rating_apparent_power",
+		Namespace: Namespace,
+		Help:      "AC output rating apparent power in volt-amps",
+	}, labels)
+
+	p.Metrics.AcOutputRatingActiveVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "acoutput_rating_active_power",
+		Namespace: Namespace,
+		Help:      "AC output rating active power in watts",
+	}, labels)
+
+	p.Metrics.ParallelMaxNumberVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "parallel_max_number",
+		Namespace: Namespace,
+		Help:      "Maximum number of inverters in parallel",
+	}, labels)
+
+	p.Metrics.RatingInfoVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "rating_info",
+		Namespace: Namespace,
+		Help:      "Rating information of the inverter, the value is always 1",
+	}, append(append([]string{}, labels...), ratingInfoLabels...))
+
+	p.Metrics.BatteryTypeInfoVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "battery_type_info",
+		Namespace: Namespace,
+		Help:      "Battery type of the inverter - agm, flooded, user or lithium, the value is always 1",
+	}, []string{LabelSerialNumber, "battery_type"})
+
 	// Statuses
 
 	p.Metrics.OverloadVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
@@ -364,6 +779,20 @@ func (p *Prometheus) RegisterMetrics() {
 		Help:      "Returns 1 if system is overloaded",
 	}, labels)
 
+	p.Metrics.WarningVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "warning",
+		Namespace: Namespace,
+		Help:      "Returns 1 if the warning or fault is active",
+	}, []string{LabelSerialNumber, LabelWarning, LabelSeverity})
+
+	// Device flags
+
+	p.Metrics.FlagVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "flag",
+		Namespace: Namespace,
+		Help:      "Returns 1 if the device flag is enabled",
+	}, []string{LabelSerialNumber, LabelFlag})
+
 	// Device mode
 
 	p.Metrics.DeviceModeVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
@@ -372,22 +801,81 @@ func (p *Prometheus) RegisterMetrics() {
 		Help:      "Shows the device mode - 0: PowerOnMode, 1: StandbyMode, 2: LineMode, 3: BatteryMode, 4: FaultMode, 5: PowerSavingMode",
 	}, labels)
 
+	p.Metrics.DeviceModeStateVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "devicemode_state",
+		Namespace: Namespace,
+		Help:      "Returns 1 for the current device mode and 0 for the others - poweron, standby, utility, battery, fault, powersaving",
+	}, []string{LabelSerialNumber, "devicemode"})
+
 	// Output mode
-	// TODO: There seem to be more output modes than the ones below
 
 	p.Metrics.OutputModeVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
 		Name:      "outputmode",
 		Namespace: Namespace,
-		Help:      "Shows the output mode - 0: SingleMachine, 1: Parallel, 2: Phase1, 3: Phase2, 4: Phase3",
+		Help:      "Shows the output mode - " + outputModeHelp,
 	}, labels)
 
+	p.Metrics.OutputModeStateVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "outputmode_state",
+		Namespace: Namespace,
+		Help:      "Returns 1 for the current output mode and 0 for the others - single, parallel, phase1, phase2, phase3, splitphase1, splitphase2_120, splitphase2_180",
+	}, []string{LabelSerialNumber, "outputmode"})
+
 	// Scrape error
 
 	p.Metrics.ScrapeError = promauto.With(p.Reg).NewGauge(prometheus.GaugeOpts{
 		Name:      "scrape_error",
 		Namespace: Namespace,
-		Help:      "Returns 1 if the last scrape failed",
+		Help:      "Returns 1 if the last scrape of any inverter failed, see the query health metrics for details",
 	})
+
+	// Energy counters of the inverter firmware
+
+	p.Metrics.EnergyCounters = NewEnergyCounterCollector()
+	p.Reg.MustRegister(p.Metrics.EnergyCounters)
+
+	// Circuit breaker
+
+	p.Metrics.CircuitBreakerStateVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "circuit_breaker_state",
+		Namespace: Namespace,
+		Help:      "Shows the state of the circuit breaker of the inverter - 0: Closed, 1: Open, 2: Half-open",
+	}, labels)
+
+	// Identity
+
+	p.Metrics.InverterInfoVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "inverter_info",
+		Namespace: Namespace,
+		Help:      "Identity of the inverter, the value is always 1",
+	}, []string{LabelSerialNumber, "protocol_id", "firmware_main", "firmware_secondary", "model"})
+
+	// Query health
+
+	p.Metrics.QueryLastSuccessVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "query_last_success_timestamp_seconds",
+		Namespace: Namespace,
+		Help:      "Unix timestamp of the last successful query",
+	}, queryLabels)
+
+	p.Metrics.QueryConsecutiveFailuresVec = promauto.With(p.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "query_consecutive_failures",
+		Namespace: Namespace,
+		Help:      "Number of failed queries since the last successful one",
+	}, queryLabels)
+
+	p.Metrics.QueryErrorsVec = promauto.With(p.Reg).NewCounterVec(prometheus.CounterOpts{
+		Name:      "query_errors_total",
+		Namespace: Namespace,
+		Help:      "Number of failed queries by error class - timeout, crc, nak, parse, io",
+	}, append(queryLabels, LabelErrorClass))
+
+	p.Metrics.QueryDurationVec = promauto.With(p.Reg).NewHistogramVec(prometheus.HistogramOpts{
+		Name:      "query_duration_seconds",
+		Namespace: Namespace,
+		Help:      "Duration of queries in seconds, including retries",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, queryLabels)
 }
 
 func convertBoolToFloat(b bool) float64 {
@@ -398,155 +886,374 @@ func convertBoolToFloat(b bool) float64 {
 	return 0.0
 }
 
-func (a *Application) CalculateMetrics() {
-	scrapeErr := false
+// Represents a group of queries that is polled at its own interval
+type queryGroup struct {
+	Name string
 
-	for _, inv := range a.Inverters {
-		log.Infof("Starting metrics retrieval from device with serialno '%s'", inv.SerialNo)
+	// Optional groups are only polled if they are in the polling schedule
+	Optional bool
 
-		inv.mu.Lock()
-		defer inv.mu.Unlock()
+	// Query the settings of the group are read from, used to read settings back after they are changed
+	Query string
 
-		var labelValues []string
+	Collect func(a *Application, inv *Inverter, c *exchangeConnector, labelValues []string) error
+}
 
-		labelValues = append(
-			labelValues,
-			inv.SerialNo,
-		)
+// Query groups in the order in which they are polled. The parallel group comes after the rating and
+// output mode groups, as the number of units it queries depends on them.
+var queryGroups = []queryGroup{
+	{Name: "status", Query: "QPIGS", Collect: (*Application).collectStatus},
+	{Name: "rating", Query: "QPIRI", Collect: (*Application).collectRatingInfo},
+	{Name: "warnings", Query: "QPIWS", Collect: (*Application).collectWarnings},
+	{Name: "mode", Query: "QMOD", Collect: (*Application).collectDeviceMode},
+	{Name: "outputmode", Query: "QOPM", Collect: (*Application).collectOutputMode},
+	{Name: "parallel", Query: "QPGS0", Collect: (*Application).collectParallelInfo},
+	{Name: "flags", Query: "QFLAG", Collect: (*Application).collectFlags},
+	{Name: "energy", Optional: true, Collect: (*Application).collectEnergyCounters},
+}
 
-		// Device status
-		dsp, err := axpert.DeviceGeneralStatus(inv.Connector)
-		if err != nil {
-			scrapeErr = true
-			log.Errorf("failed to retrieve device general status from from device with serialno '%s'", inv.SerialNo)
-		} else {
-			log.Debugln("device general status:")
-			log.Debugf("%+v", dsp)
-
-			a.Prometheus.Metrics.GridFrequencyVec.WithLabelValues(labelValues...).Set(float64(dsp.GridFrequency))
-			a.Prometheus.Metrics.GridVoltageVec.WithLabelValues(labelValues...).Set(float64(dsp.GridVoltage))
-			a.Prometheus.Metrics.PvInputVoltage1Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputVoltage1))
-			a.Prometheus.Metrics.PvInputVoltage2Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputVoltage2))
-			a.Prometheus.Metrics.PvInputVoltage3Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputVoltage3))
-			a.Prometheus.Metrics.PvInputCurrent1Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputCurrent1))
-			a.Prometheus.Metrics.PvInputCurrent2Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputCurrent2))
-			a.Prometheus.Metrics.PvInputCurrent3Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputCurrent3))
-			a.Prometheus.Metrics.AcOutputVoltageVec.WithLabelValues(labelValues...).Set(float64(dsp.ACOutputVoltage))
-			a.Prometheus.Metrics.AcOutputFrequencyVec.WithLabelValues(labelValues...).Set(float64(dsp.ACOutputFrequency))
-			a.Prometheus.Metrics.AcOutputApparentPowerVec.WithLabelValues(labelValues...).Set(float64(dsp.ACOutputApparentPower))
-			a.Prometheus.Metrics.AcOutputActivePowerVec.WithLabelValues(labelValues...).Set(float64(dsp.ACOutputActivePower))
-			a.Prometheus.Metrics.OutputLoadPercentVec.WithLabelValues(labelValues...).Set(float64(dsp.OutputLoadPercent))
-			a.Prometheus.Metrics.HeatSinkTempVec.WithLabelValues(labelValues...).Set(float64(dsp.HeatSinkTemperature))
-			a.Prometheus.Metrics.BatVoltageVec.WithLabelValues(labelValues...).Set(float64(dsp.BatteryVoltage))
-			a.Prometheus.Metrics.BatCapacityVec.WithLabelValues(labelValues...).Set(float64(dsp.BatteryCapacity))
-			a.Prometheus.Metrics.BatChgCurrentVec.WithLabelValues(labelValues...).Set(float64(dsp.BatteryChargingCurrent))
-			a.Prometheus.Metrics.BatDischgCurrentVec.WithLabelValues(labelValues...).Set(float64(dsp.BatteryDischargeCurrent))
-			a.Prometheus.Metrics.ChargeOnVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(dsp.ChargingOn))
-			a.Prometheus.Metrics.SCCChargeOn1Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(dsp.SCC1ChargingOn))
-			a.Prometheus.Metrics.SCCChargeOn2Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(dsp.SCC2ChargingOn))
-			a.Prometheus.Metrics.SCCChargeOn3Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(dsp.SCC3ChargingOn))
-		}
+// Retrieves the metrics of the given query groups from a single inverter. The inverter lock is held
+// while the groups are polled, so control commands for this inverter wait until they are finished.
+func (a *Application) CalculateMetrics(inv *Inverter, groups []queryGroup) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
 
-		// Parallel device information
-		pi, err := axpert.ParallelDeviceInfo(inv.Connector, 0)
-		if err != nil {
-			scrapeErr = true
-			log.Errorf("failed to retrieve parallel device info from device with serialno '%s'", inv.SerialNo)
-		} else {
-			log.Debugln("parallel device information:")
-			log.Debugf("%+v", pi)
+	c, err := a.conn(inv)
+	if err != nil {
+		inv.scrapeErr.Store(true)
+		log.Debugf("Skipping metrics retrieval from disconnected device with serialno '%s'", inv.SerialNo)
+		return
+	}
 
-			if err := inv.UpdateCurrentSettings(pi); err != nil {
-				log.Errorf("failed to update current settings for device with serialno '%s': %s", inv.SerialNo, err)
-			}
+	// An open circuit breaker counts as a failed cycle, so the supervisor eventually reconnects the device
+	if inv.breaker.isOpen(time.Now()) {
+		_, openUntil := inv.breaker.State()
+		inv.scrapeErr.Store(true)
+		inv.failures++
+		log.Debugf("Skipping metrics retrieval from device with serialno '%s' until %s, circuit breaker is open", inv.SerialNo, openUntil.Format(time.RFC3339))
+		return
+	}
 
-			a.Prometheus.Metrics.LoadOnVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(pi.LoadOn))
-			a.Prometheus.Metrics.LineLossVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(pi.LineLoss))
-			a.Prometheus.Metrics.ACChargeOnVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(pi.ACCharging))
-		}
+	log.Infof("Starting metrics retrieval from device with serialno '%s'", inv.SerialNo)
+
+	if inv.groupErrs == nil {
+		inv.groupErrs = make(map[string]bool)
+	}
 
-		// Rating info
-		ri, err := axpert.DeviceRatingInfo(inv.Connector)
+	var labelValues []string
+
+	labelValues = append(
+		labelValues,
+		inv.SerialNo,
+	)
+
+	// Number of query groups that failed, to detect devices that no longer respond
+	failed := 0
+
+	for _, g := range groups {
+		err := g.Collect(a, inv, c, labelValues)
 		if err != nil {
-			scrapeErr = true
-			log.Errorf("failed to retrieve rating info from device with serialno '%s'", inv.SerialNo)
-		} else {
-			log.Debugln("rating information:")
-			log.Debugf("%+v", ri)
-
-			a.Prometheus.Metrics.OutputSourcePrioVec.WithLabelValues(labelValues...).Set(float64(ri.OutputSourcePriority))
-			a.Prometheus.Metrics.ChargerSourcePrioVec.WithLabelValues(labelValues...).Set(float64(ri.ChargerSourcePriority))
-			a.Prometheus.Metrics.MaxACChargerCurrentVec.WithLabelValues(labelValues...).Set(float64(ri.MaxACChargingCurrent))
-			a.Prometheus.Metrics.BatteryRechgVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.BatteryRechargeVoltage))
-			a.Prometheus.Metrics.BatteryRedischgVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.BatteryRedischargeVoltage))
-			a.Prometheus.Metrics.BatteryUnderVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.BatteryUnderVoltage))
-			a.Prometheus.Metrics.BatteryFloatVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.BatteryFloatVoltage))
-
-			if err := inv.UpdateCurrentSettings(ri); err != nil {
-				log.Errorf("failed to update current settings for device with serialno '%s': %s", inv.SerialNo, err)
-			}
+			failed++
+			log.Errorf("%s from device with serialno '%s'", err, inv.SerialNo)
 		}
 
-		// Statuses
-		warnOverload := false
+		inv.groupErrs[g.Name] = err != nil
+	}
 
-		wns, err := axpert.WarningStatus(inv.Connector)
-		if err != nil {
+	scrapeErr := false
+	for _, failed := range inv.groupErrs {
+		if failed {
 			scrapeErr = true
-			log.Errorf("failed to retrieve warnings from device with serialno '%s'", inv.SerialNo)
-		} else {
-			log.Debugln("wns:")
-			log.Debugf("%+v", wns)
-			for _, wn := range wns {
-				if wn == axpert.WarnOverload {
-					warnOverload = true
-				}
-			}
+		}
+	}
+	inv.scrapeErr.Store(scrapeErr)
+
+	if failed == len(groups) {
+		inv.failures++
+	} else {
+		inv.failures = 0
+	}
+
+	log.Infof("Finished metrics retrieval from device with serialno '%s'", inv.SerialNo)
+}
+
+// Exports the identity of an inverter. The inverter lock must be held.
+func (a *Application) exportIdentity(inv *Inverter) {
+	id := inv.Identity
+
+	a.Prometheus.Metrics.InverterInfoVec.DeletePartialMatch(prometheus.Labels{LabelSerialNumber: inv.SerialNo})
+	a.Prometheus.Metrics.InverterInfoVec.WithLabelValues(inv.SerialNo, id.ProtocolID, id.FirmwareMain, id.FirmwareSecondary, id.Model).Set(1)
+}
+
+// Retrieves the device general status (QPIGS)
+func (a *Application) collectStatus(inv *Inverter, c *exchangeConnector, labelValues []string) error {
+	dsp, err := observe(c, "QPIGS", axpert.DeviceGeneralStatus)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve device general status: %w", err)
+	}
+
+	log.Debugln("device general status:")
+	log.Debugf("%+v", dsp)
+
+	a.Prometheus.Metrics.GridFrequencyVec.WithLabelValues(labelValues...).Set(float64(dsp.GridFrequency))
+	a.Prometheus.Metrics.GridVoltageVec.WithLabelValues(labelValues...).Set(float64(dsp.GridVoltage))
+	a.Prometheus.Metrics.PvInputVoltage1Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputVoltage1))
+	a.Prometheus.Metrics.PvInputVoltage2Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputVoltage2))
+	a.Prometheus.Metrics.PvInputVoltage3Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputVoltage3))
+	a.Prometheus.Metrics.PvInputCurrent1Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputCurrent1))
+	a.Prometheus.Metrics.PvInputCurrent2Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputCurrent2))
+	a.Prometheus.Metrics.PvInputCurrent3Vec.WithLabelValues(labelValues...).Set(float64(dsp.PVInputCurrent3))
+	a.Prometheus.Metrics.AcOutputVoltageVec.WithLabelValues(labelValues...).Set(float64(dsp.ACOutputVoltage))
+	a.Prometheus.Metrics.AcOutputFrequencyVec.WithLabelValues(labelValues...).Set(float64(dsp.ACOutputFrequency))
+	a.Prometheus.Metrics.AcOutputApparentPowerVec.WithLabelValues(labelValues...).Set(float64(dsp.ACOutputApparentPower))
+	a.Prometheus.Metrics.AcOutputActivePowerVec.WithLabelValues(labelValues...).Set(float64(dsp.ACOutputActivePower))
+	a.Prometheus.Metrics.OutputLoadPercentVec.WithLabelValues(labelValues...).Set(float64(dsp.OutputLoadPercent))
+	a.Prometheus.Metrics.HeatSinkTempVec.WithLabelValues(labelValues...).Set(float64(dsp.HeatSinkTemperature))
+	a.Prometheus.Metrics.BatVoltageVec.WithLabelValues(labelValues...).Set(float64(dsp.BatteryVoltage))
+	a.Prometheus.Metrics.BatCapacityVec.WithLabelValues(labelValues...).Set(float64(dsp.BatteryCapacity))
+	a.Prometheus.Metrics.BatChgCurrentVec.WithLabelValues(labelValues...).Set(float64(dsp.BatteryChargingCurrent))
+	a.Prometheus.Metrics.BatDischgCurrentVec.WithLabelValues(labelValues...).Set(float64(dsp.BatteryDischargeCurrent))
+	a.Prometheus.Metrics.ChargeOnVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(dsp.ChargingOn))
+	a.Prometheus.Metrics.SCCChargeOn1Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(dsp.SCC1ChargingOn))
+	a.Prometheus.Metrics.SCCChargeOn2Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(dsp.SCC2ChargingOn))
+	a.Prometheus.Metrics.SCCChargeOn3Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(dsp.SCC3ChargingOn))
+
+	pf := derivePowerFlows(dsp)
+
+	a.Prometheus.Metrics.PvInputPower1Vec.WithLabelValues(labelValues...).Set(pf.PV1)
+	a.Prometheus.Metrics.PvInputPower2Vec.WithLabelValues(labelValues...).Set(pf.PV2)
+	a.Prometheus.Metrics.PvInputPower3Vec.WithLabelValues(labelValues...).Set(pf.PV3)
+	a.Prometheus.Metrics.PvPowerVec.WithLabelValues(labelValues...).Set(pf.PV)
+	a.Prometheus.Metrics.BatPowerVec.WithLabelValues(labelValues...).Set(pf.Battery())
+	a.Prometheus.Metrics.GridImportPowerVec.WithLabelValues(labelValues...).Set(pf.GridImport)
+	a.Prometheus.Metrics.SelfConsumptionRatioVec.WithLabelValues(labelValues...).Set(pf.SelfConsumptionRatio())
+
+	e := a.Energy.Add(inv.SerialNo, time.Now(), pf)
+
+	a.Prometheus.Metrics.PvEnergyVec.WithLabelValues(labelValues...).Add(e.PV)
+	a.Prometheus.Metrics.BatChgEnergyVec.WithLabelValues(labelValues...).Add(e.BatteryCharge)
+	a.Prometheus.Metrics.BatDischgEnergyVec.WithLabelValues(labelValues...).Add(e.BatteryDischarge)
+	a.Prometheus.Metrics.LoadEnergyVec.WithLabelValues(labelValues...).Add(e.Load)
+	a.Prometheus.Metrics.GridImportEnergyVec.WithLabelValues(labelValues...).Add(e.GridImport)
+
+	return nil
+}
+
+// Retrieves the rating information (QPIRI)
+func (a *Application) collectRatingInfo(inv *Inverter, c *exchangeConnector, labelValues []string) error {
+	ri, err := observe(c, "QPIRI", axpert.DeviceRatingInfo)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve rating info: %w", err)
+	}
+
+	log.Debugln("rating information:")
+	log.Debugf("%+v", ri)
+
+	a.Prometheus.Metrics.OutputSourcePrioVec.WithLabelValues(labelValues...).Set(float64(ri.OutputSourcePriority))
+	a.Prometheus.Metrics.ChargerSourcePrioVec.WithLabelValues(labelValues...).Set(float64(ri.ChargerSourcePriority))
+	a.Prometheus.Metrics.MaxACChargerCurrentVec.WithLabelValues(labelValues...).Set(float64(ri.MaxACChargingCurrent))
+	a.Prometheus.Metrics.BatteryRechgVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.BatteryRechargeVoltage))
+	a.Prometheus.Metrics.BatteryRedischgVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.BatteryRedischargeVoltage))
+	a.Prometheus.Metrics.BatteryUnderVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.BatteryUnderVoltage))
+	a.Prometheus.Metrics.BatteryFloatVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.BatteryFloatVoltage))
+	a.Prometheus.Metrics.BatteryBulkVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.BatteryBulkVoltage))
+	a.Prometheus.Metrics.BatteryRatingVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.BatteryRatingVoltage))
+	a.Prometheus.Metrics.MaxChargerCurrentVec.WithLabelValues(labelValues...).Set(float64(ri.MaxChargingCurrent))
+	a.Prometheus.Metrics.GridRatingVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.GridRatingVoltage))
+	a.Prometheus.Metrics.GridRatingCurrentVec.WithLabelValues(labelValues...).Set(float64(ri.GridRatingCurrent))
+	a.Prometheus.Metrics.AcOutputRatingVoltageVec.WithLabelValues(labelValues...).Set(float64(ri.ACOutputRatingVoltage))
+	a.Prometheus.Metrics.AcOutputRatingFreqVec.WithLabelValues(labelValues...).Set(float64(ri.ACOutputRatingFrequency))
+	a.Prometheus.Metrics.AcOutputRatingCurrentVec.WithLabelValues(labelValues...).Set(float64(ri.ACOutputRatingCurrent))
+	a.Prometheus.Metrics.AcOutputRatingApparentVec.WithLabelValues(labelValues...).Set(float64(ri.ACOutputRatingApparentPower))
+	a.Prometheus.Metrics.AcOutputRatingActiveVec.WithLabelValues(labelValues...).Set(float64(ri.ACOutputRatingActivePower))
+	a.Prometheus.Metrics.ParallelMaxNumberVec.WithLabelValues(labelValues...).Set(float64(ri.ParallelMaxNumber))
+
+	// Drop the series with the previous settings before exporting the current ones
+	a.Prometheus.Metrics.RatingInfoVec.DeletePartialMatch(prometheus.Labels{LabelSerialNumber: inv.SerialNo})
+	a.Prometheus.Metrics.RatingInfoVec.WithLabelValues(
+		inv.SerialNo,
+		mapBatteryType(ri.BatteryType),
+		mapInputVoltageRange(ri.InputVoltageRange),
+		mapMachineType(ri.MachineType),
+		mapTopology(ri.Topology),
+		mapOutputMode(ri.OutputMode),
+		mapParallelPVOK(ri.ParallelPVOK),
+		mapPVPowerBalance(ri.PVPowerBalance),
+	).Set(1)
+
+	a.Prometheus.Metrics.BatteryTypeInfoVec.DeletePartialMatch(prometheus.Labels{LabelSerialNumber: inv.SerialNo})
+	a.Prometheus.Metrics.BatteryTypeInfoVec.WithLabelValues(inv.SerialNo, mapBatteryType(ri.BatteryType)).Set(1)
+
+	if err := inv.UpdateCurrentSettings(ri); err != nil {
+		log.Errorf("failed to update current settings for device with serialno '%s': %s", inv.SerialNo, err)
+	}
+
+	return nil
+}
+
+// Retrieves the warning status (QPIWS)
+func (a *Application) collectWarnings(inv *Inverter, c *exchangeConnector, labelValues []string) error {
+	warnOverload := false
+
+	wns, err := observe(c, "QPIWS", axpert.WarningStatus)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve warnings: %w", err)
+	}
 
-			a.Prometheus.Metrics.OverloadVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(warnOverload))
+	log.Debugln("wns:")
+	log.Debugf("%+v", wns)
+	for _, wn := range wns {
+		if wn == axpert.WarnOverload {
+			warnOverload = true
 		}
+	}
 
-		// Device mode
-		md, err := axpert.DeviceMode(inv.Connector)
-		if err != nil {
-			scrapeErr = true
-			log.Errorf("failed to retrieve device mode from device with serialno '%s'", inv.SerialNo)
-		} else {
-			log.Debugln("device mode:", md)
-
-			mode, err := parseDeviceMode(md)
-			if err != nil {
-				scrapeErr = true
-				log.Errorf("failed to parse device mode from device with serialno '%s': %s", inv.SerialNo, err)
-			} else {
-				if err := inv.UpdateCurrentSettings(md); err != nil {
-					log.Errorf("failed to update current settings for device with serialno '%s': %s", inv.SerialNo, err)
-				}
-
-				a.Prometheus.Metrics.DeviceModeVec.WithLabelValues(labelValues...).Set(mode)
+	a.Prometheus.Metrics.OverloadVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(warnOverload))
+
+	inv.Warnings = activeWarnings(wns)
+
+	active := make(map[string]bool)
+	for _, aw := range inv.Warnings {
+		active[aw.Warning] = true
+	}
+
+	for _, wf := range warningFlags {
+		severity := wf.severity(active["inverter_fault"])
+
+		// Flags of which the severity depends on the inverter fault flag must not keep the series
+		// of the other severity
+		if wf.Severity == "" {
+			other := severityFault
+			if severity == severityFault {
+				other = severityWarning
 			}
+			a.Prometheus.Metrics.WarningVec.DeleteLabelValues(inv.SerialNo, wf.Name, other)
 		}
 
-		// Output mode
-		om, err := axpert.DeviceOutputMode(inv.Connector)
-		if err != nil {
-			scrapeErr = true
-			log.Errorf("failed to retrieve device output mode from device with serialno '%s'", inv.SerialNo)
-		} else {
-			log.Debugln("device output mode:", om)
+		a.Prometheus.Metrics.WarningVec.WithLabelValues(inv.SerialNo, wf.Name, severity).Set(convertBoolToFloat(active[wf.Name]))
+	}
+
+	return nil
+}
+
+// Retrieves the device flag status (QFLAG). Inverters that answer with NAK are no longer polled.
+func (a *Application) collectFlags(inv *Inverter, c *exchangeConnector, labelValues []string) error {
+	if inv.unsupported == nil {
+		inv.unsupported = make(map[string]bool)
+	}
+	if inv.unsupported["QFLAG"] {
+		return nil
+	}
+
+	fl, err := observe(c, "QFLAG", readDeviceFlags)
+	if errors.Is(err, errNotSupported) {
+		log.Infof("Device with serialno '%s' does not support QFLAG, no longer polling it", inv.SerialNo)
+		inv.unsupported["QFLAG"] = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to retrieve device flags: %w", err)
+	}
+
+	log.Debugln("device flags:")
+	log.Debugf("%+v", fl)
+
+	if err := inv.UpdateCurrentSettings(fl); err != nil {
+		log.Errorf("failed to update current settings for device with serialno '%s': %s", inv.SerialNo, err)
+	}
+
+	a.exportFlags(inv.SerialNo, flagStates(fl))
 
-			a.Prometheus.Metrics.OutputModeVec.WithLabelValues(labelValues...).Set(float64(om))
+	return nil
+}
+
+// Exports the device flags of an inverter, series of flags it no longer reports are removed
+func (a *Application) exportFlags(serialNo string, states map[string]bool) {
+	for _, df := range deviceFlags {
+		on, ok := states[df.Name]
+		if !ok {
+			a.Prometheus.Metrics.FlagVec.DeleteLabelValues(serialNo, df.Name)
+			continue
 		}
+		a.Prometheus.Metrics.FlagVec.WithLabelValues(serialNo, df.Name).Set(convertBoolToFloat(on))
+	}
+}
 
-		log.Infof("Finished metrics retrieval from device with serialno '%s'", inv.SerialNo)
+// Retrieves the device mode (QMOD)
+func (a *Application) collectDeviceMode(inv *Inverter, c *exchangeConnector, labelValues []string) error {
+	md, err := observe(c, "QMOD", axpert.DeviceMode)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve device mode: %w", err)
 	}
 
-	if scrapeErr {
-		a.Prometheus.Metrics.ScrapeError.Set(1)
-		return
+	log.Debugln("device mode:", md)
+
+	mode, err := parseDeviceMode(md)
+	if err != nil {
+		return fmt.Errorf("failed to parse device mode: %w", err)
+	}
+
+	if err := inv.UpdateCurrentSettings(md); err != nil {
+		log.Errorf("failed to update current settings for device with serialno '%s': %s", inv.SerialNo, err)
+	}
+
+	a.Prometheus.Metrics.DeviceModeVec.WithLabelValues(labelValues...).Set(mode)
+	for _, m := range deviceModes {
+		a.Prometheus.Metrics.DeviceModeStateVec.WithLabelValues(inv.SerialNo, mapDeviceMode(m)).Set(convertBoolToFloat(m == md))
 	}
 
-	a.Prometheus.Metrics.ScrapeError.Set(0)
+	return nil
+}
+
+// Retrieves the device output mode (QOPM)
+func (a *Application) collectOutputMode(inv *Inverter, c *exchangeConnector, labelValues []string) error {
+	om, err := observe(c, "QOPM", axpert.DeviceOutputMode)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve device output mode: %w", err)
+	}
+
+	log.Debugln("device output mode:", om)
+
+	if err := inv.UpdateCurrentSettings(om); err != nil {
+		log.Errorf("failed to update current settings for device with serialno '%s': %s", inv.SerialNo, err)
+	}
+
+	a.Prometheus.Metrics.OutputModeVec.WithLabelValues(labelValues...).Set(float64(om))
+	for _, m := range outputModes {
+		a.Prometheus.Metrics.OutputModeStateVec.WithLabelValues(inv.SerialNo, mapOutputMode(m)).Set(convertBoolToFloat(m == om))
+	}
+
+	return nil
+}
+
+// Retrieves the energy counters of the inverter firmware (QET, QEY, QEM, QED, QLT, QLY, QLM, QLD).
+// Counters the inverter answers with NAK are no longer polled.
+func (a *Application) collectEnergyCounters(inv *Inverter, c *exchangeConnector, labelValues []string) error {
+	if inv.unsupported == nil {
+		inv.unsupported = make(map[string]bool)
+	}
+
+	now := time.Now()
+	for _, q := range energyQueries {
+		if inv.unsupported[q.Prefix] {
+			continue
+		}
+
+		v, err := readEnergyCounter(c, q, now)
+		if errors.Is(err, errNotSupported) {
+			log.Infof("Device with serialno '%s' does not support %s, no longer polling it", inv.SerialNo, q.Prefix)
+			inv.unsupported[q.Prefix] = true
+			a.Prometheus.Metrics.EnergyCounters.Delete(inv.SerialNo, q)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to retrieve energy counter %s: %w", q.Prefix, err)
+		}
+
+		a.Prometheus.Metrics.EnergyCounters.Set(inv.SerialNo, q, v)
+	}
+
+	return nil
 }
 
 func parseDeviceMode(m string) (float64, error) {
@@ -567,13 +1274,3 @@ func parseDeviceMode(m string) (float64, error) {
 		return -1.0, fmt.Errorf("unknown device mode: %s", m)
 	}
 }
-
-func startMetricsCollection(a *Application, t time.Duration) {
-	tck := time.NewTicker(t)
-	defer tck.Stop()
-
-	for {
-		a.CalculateMetrics()
-		<-tck.C
-	}
-}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/howeyc/crc16"
+	"github.com/marevers/energia/pkg/connector"
+)
+
+const (
+	cr        byte = 0x0d
+	lf        byte = 0x0a
+	leftParen byte = 0x28
+)
+
+var (
+	errInvalidFrame = errors.New("invalid frame")
+	errCRC          = errors.New("CRC error in frame")
+)
+
+// Calculates the CRC of a protocol frame. Bytes that would be mistaken for a
+// frame delimiter are incremented, as done by the inverter firmware.
+func crc(data []byte) []byte {
+	i := crc16.Checksum(data, crc16.CCITTFalseTable)
+	bs := []byte{uint8(i >> 8), uint8(i & 0xff)}
+	for i := range bs {
+		if bs[i] == lf || bs[i] == cr || bs[i] == leftParen {
+			bs[i] += 1
+		}
+	}
+
+	return bs
+}
+
+// Encodes a payload into a protocol frame: payload, CRC and carriage return
+func encodeFrame(payload []byte) []byte {
+	frame := append([]byte{}, payload...)
+	frame = append(frame, crc(payload)...)
+	return append(frame, cr)
+}
+
+// Decodes a protocol frame and returns its payload after validating the CRC
+func decodeFrame(frame []byte) ([]byte, error) {
+	if len(frame) < 3 || frame[len(frame)-1] != cr {
+		return nil, fmt.Errorf("%w %q", errInvalidFrame, frame)
+	}
+
+	payload := frame[:len(frame)-3]
+	if !bytes.Equal(frame[len(frame)-3:len(frame)-1], crc(payload)) {
+		return nil, fmt.Errorf("%w %q", errCRC, frame)
+	}
+
+	return payload, nil
+}
+
+// Sends a request the axpert package has no function for and returns the response payload without
+// the leading parenthesis
+func sendRequest(c connector.Connector, req string) (string, error) {
+	if err := c.Write(encodeFrame([]byte(req))); err != nil {
+		return "", err
+	}
+
+	frame, err := c.ReadUntilCR()
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := decodeFrame(frame)
+	if err != nil {
+		return "", err
+	}
+
+	if len(payload) < 1 || payload[0] != leftParen {
+		return "", fmt.Errorf("%w %q", errInvalidFrame, frame)
+	}
+
+	return string(payload[1:]), nil
+}
+
+// Sends a command the axpert package has no function for and returns an error unless the inverter
+// acknowledges it
+func sendCommand(c connector.Connector, cmd string) error {
+	resp, err := sendRequest(c, cmd)
+	if err != nil {
+		return err
+	}
+
+	if resp != "ACK" {
+		return fmt.Errorf("command not acknowledged, %s", resp)
+	}
+
+	return nil
+}
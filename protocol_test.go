@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncodeFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{name: "query", payload: "QPIGS", want: "QPIGS\xb7\xa9\r"},
+		{name: "warning status", payload: "QPIWS", want: "QPIWS\xb4\xda\r"},
+		{name: "acknowledgement", payload: "(ACK", want: "(ACK\x39\x20\r"},
+		{name: "refusal", payload: "(NAK", want: "(NAK\x73\x73\r"},
+		// The CRC is 0xe20a, of which the line feed is incremented
+		{name: "delimiter in CRC", payload: "POP02", want: "POP02\xe2\x0b\r"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := encodeFrame([]byte(tt.payload))
+			if !bytes.Equal(got, []byte(tt.want)) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+
+			payload, err := decodeFrame(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(payload) != tt.payload {
+				t.Errorf("got payload %q, want %q", payload, tt.payload)
+			}
+		})
+	}
+}
+
+func TestCRCAvoidsDelimiters(t *testing.T) {
+	for i := range 1 << 16 {
+		payload := []byte{byte(i >> 8), byte(i)}
+		for _, b := range crc(payload) {
+			if b == cr || b == lf || b == leftParen {
+				t.Fatalf("CRC of %q contains delimiter %q", payload, b)
+			}
+		}
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   string
+		want    string
+		wantErr error
+	}{
+		{name: "response", frame: "(ACK\x39\x20\r", want: "(ACK"},
+		{name: "wrong CRC", frame: "(ACK\x39\x21\r", wantErr: errCRC},
+		{name: "unadjusted CRC", frame: "POP02\xe2\x0a\r", wantErr: errCRC},
+		{name: "truncated", frame: "(ACK\r", wantErr: errCRC},
+		{name: "too short", frame: "\x39\r", wantErr: errInvalidFrame},
+		{name: "empty", frame: "", wantErr: errInvalidFrame},
+		{name: "missing carriage return", frame: "(ACK\x39\x20", wantErr: errInvalidFrame},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeFrame([]byte(tt.frame))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && string(got) != tt.want {
+				t.Errorf("got payload %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marevers/energia/pkg/connector"
+	log "github.com/sirupsen/logrus"
+)
+
+// Directions of recorded traffic
+const (
+	recordRequest  = ">"
+	recordResponse = "<"
+	recordError    = "!"
+)
+
+// Writes the raw protocol traffic of one or more connectors to a file. Every line holds a
+// timestamp, the direction, the quoted device name and the quoted frame or error:
+//
+//	2025-01-01T12:00:00.000000Z > "/dev/hidraw0" "QPIGS\xb7\xa9\r"
+type Recorder struct {
+	mu sync.Mutex
+	f  *os.File
+
+	// Set after the first failed write, which stops the recording
+	failed bool
+}
+
+// Creates a recorder that appends to the given file
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{f: f}, nil
+}
+
+// Wraps a connector so all of its traffic is recorded under the given device name
+func (r *Recorder) Wrap(device string, c connector.Connector) connector.Connector {
+	return &RecordingConnector{
+		device: device,
+		c:      c,
+		rec:    r,
+	}
+}
+
+// Closes the recording file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.f.Close()
+}
+
+func (r *Recorder) write(device, direction string, data []byte) {
+	line := fmt.Sprintf("%s %s %s %s\n",
+		time.Now().UTC().Format(time.RFC3339Nano), direction, strconv.Quote(device), strconv.Quote(string(data)))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failed {
+		return
+	}
+
+	// A partial recording is still useful, so the traffic is no longer recorded instead of failing requests
+	if _, err := r.f.WriteString(line); err != nil {
+		r.failed = true
+		log.Errorf("Failed to write to recording %s, recording stopped: %v", r.f.Name(), err)
+	}
+}
+
+// Represents a connector of which all traffic is recorded
+type RecordingConnector struct {
+	device string
+	c      connector.Connector
+	rec    *Recorder
+}
+
+func (rc *RecordingConnector) Open() error {
+	return rc.c.Open()
+}
+
+func (rc *RecordingConnector) Close() {
+	rc.c.Close()
+}
+
+func (rc *RecordingConnector) ReadUntilCR() ([]byte, error) {
+	return rc.Read(cr)
+}
+
+func (rc *RecordingConnector) Read(terminator byte) ([]byte, error) {
+	b, err := rc.c.Read(terminator)
+	if err != nil {
+		rc.rec.write(rc.device, recordError, []byte(err.Error()))
+		return nil, err
+	}
+
+	rc.rec.write(rc.device, recordResponse, b)
+
+	return b, nil
+}
+
+func (rc *RecordingConnector) Write(b []byte) error {
+	rc.rec.write(rc.device, recordRequest, b)
+
+	if err := rc.c.Write(b); err != nil {
+		rc.rec.write(rc.device, recordError, []byte(err.Error()))
+		return err
+	}
+
+	return nil
+}
+
+// Represents a recorded request and the response or error it produced
+type exchange struct {
+	request  []byte
+	response []byte
+	err      string
+}
+
+// Loads a recording and returns the exchanges per device, together with the device names in
+// order of first appearance
+func loadRecording(path string) (map[string][]exchange, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	exchanges := make(map[string][]exchange)
+	var devices []string
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		direction, device, data, err := parseRecordLine(scanner.Text())
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+
+		exs, seen := exchanges[device]
+		if !seen {
+			devices = append(devices, device)
+		}
+
+		switch direction {
+		case recordRequest:
+			exs = append(exs, exchange{request: data})
+		case recordResponse, recordError:
+			if len(exs) == 0 || exs[len(exs)-1].response != nil || exs[len(exs)-1].err != "" {
+				return nil, nil, fmt.Errorf("%s:%d: %s without request", path, n, direction)
+			}
+			if direction == recordResponse {
+				exs[len(exs)-1].response = data
+			} else {
+				exs[len(exs)-1].err = string(data)
+			}
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: unknown direction %q", path, n, direction)
+		}
+
+		exchanges[device] = exs
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(devices) < 1 {
+		return nil, nil, fmt.Errorf("%s: recording is empty", path)
+	}
+
+	return exchanges, devices, nil
+}
+
+// Parses a single line of a recording
+func parseRecordLine(line string) (direction, device string, data []byte, err error) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 3 {
+		return "", "", nil, errors.New("not enough fields")
+	}
+
+	if _, err := time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+		return "", "", nil, err
+	}
+	direction = fields[1]
+
+	rest := fields[2]
+	qd, err := strconv.QuotedPrefix(rest)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("invalid device: %w", err)
+	}
+	if device, err = strconv.Unquote(qd); err != nil {
+		return "", "", nil, err
+	}
+
+	qf := strings.TrimPrefix(rest[len(qd):], " ")
+	frame, err := strconv.Unquote(qf)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("invalid frame: %w", err)
+	}
+
+	return direction, device, []byte(frame), nil
+}
+
+// Represents a connector that answers requests from a recording. Requests are matched against
+// the recorded requests in order, wrapping around at the end of the recording, so a recording
+// of a few collection cycles can be replayed indefinitely.
+type ReplayConnector struct {
+	device    string
+	exchanges []exchange
+	pos       int
+	pending   *exchange
+}
+
+// Creates a replay connector for the recorded exchanges of a device
+func NewReplayConnector(device string, exchanges []exchange) *ReplayConnector {
+	return &ReplayConnector{
+		device:    device,
+		exchanges: exchanges,
+	}
+}
+
+func (rc *ReplayConnector) Open() error {
+	return nil
+}
+
+func (rc *ReplayConnector) Close() {
+	rc.pending = nil
+}
+
+func (rc *ReplayConnector) ReadUntilCR() ([]byte, error) {
+	return rc.Read(cr)
+}
+
+// Returns the recorded response, or error, for the last written request
+func (rc *ReplayConnector) Read(terminator byte) ([]byte, error) {
+	if rc.pending == nil {
+		return nil, errors.New("no request pending")
+	}
+
+	ex := rc.pending
+	rc.pending = nil
+
+	if ex.err != "" {
+		return nil, errors.New(ex.err)
+	}
+	if ex.response == nil {
+		return nil, fmt.Errorf("no response recorded for %q", ex.request)
+	}
+
+	return ex.response, nil
+}
+
+// Looks up the next recorded exchange for the request
+func (rc *ReplayConnector) Write(b []byte) error {
+	for i := range rc.exchanges {
+		n := (rc.pos + i) % len(rc.exchanges)
+		if bytes.Equal(rc.exchanges[n].request, b) {
+			rc.pending = &rc.exchanges[n]
+			rc.pos = n + 1
+			return nil
+		}
+	}
+
+	return fmt.Errorf("request %q not found in recording of %s", b, rc.device)
+}
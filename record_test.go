@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns the values of the inverter gauges of an application by metric name and labels. Timestamps
+// are left out, as they differ between a recording and its replay.
+func gaugeValues(t *testing.T, app *Application) map[string]float64 {
+	t.Helper()
+
+	families, err := app.Prometheus.Reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make(map[string]float64)
+	for _, mf := range families {
+		if !strings.HasPrefix(mf.GetName(), Namespace+"_") || strings.Contains(mf.GetName(), "timestamp") {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			if m.GetGauge() == nil {
+				continue
+			}
+
+			key := mf.GetName()
+			for _, l := range m.GetLabel() {
+				key += " " + l.GetName() + "=" + l.GetValue()
+			}
+			values[key] = m.GetGauge().GetValue()
+		}
+	}
+
+	return values
+}
+
+// Collects the metrics of all query groups that are polled by default from a new inverter
+func collectAll(t *testing.T, inv *Inverter) *Application {
+	t.Helper()
+
+	energy, err := NewEnergyMeter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Application{
+		Prometheus: &Prometheus{Reg: createRegistry()},
+		Inverters:  []*Inverter{inv},
+		Energy:     energy,
+	}
+	app.Prometheus.RegisterMetrics()
+
+	var groups []queryGroup
+	for _, g := range queryGroups {
+		if !g.Optional {
+			groups = append(groups, g)
+		}
+	}
+	app.CalculateMetrics(inv, groups)
+
+	return app
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.rec")
+
+	rec, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := newInverter(NewSimulatedConnector(0), "sim0", rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := gaugeValues(t, collectAll(t, inv))
+
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	exchanges, devices, err := loadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0] != "sim0" {
+		t.Fatalf("got devices %v, want [sim0]", devices)
+	}
+
+	replayInv, err := newInverter(NewReplayConnector("sim0", exchanges["sim0"]), "sim0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := gaugeValues(t, collectAll(t, replayInv))
+
+	if _, ok := recorded["axpert_battery_voltage serialno="+inv.SerialNo]; !ok {
+		t.Fatal("the general status was not recorded")
+	}
+	for key, want := range recorded {
+		got, ok := replayed[key]
+		if !ok {
+			t.Errorf("%s missing from replay", key)
+		} else if got != want {
+			t.Errorf("%s: got %g on replay, want %g", key, got, want)
+		}
+	}
+	if len(replayed) != len(recorded) {
+		t.Errorf("got %d gauges on replay, want %d", len(replayed), len(recorded))
+	}
+}
+
+func TestParseRecordLine(t *testing.T) {
+	tests := []struct {
+		name          string
+		line          string
+		wantDirection string
+		wantDevice    string
+		wantData      string
+		wantErr       string
+	}{
+		{
+			name:          "request",
+			line:          `2025-01-01T12:00:00.000000Z > "/dev/hidraw0" "QPIGS\xb7\xa9\r"`,
+			wantDirection: recordRequest,
+			wantDevice:    "/dev/hidraw0",
+			wantData:      "QPIGS\xb7\xa9\r",
+		},
+		{
+			name:          "device with spaces",
+			line:          `2025-01-01T12:00:00Z ! "bridge 1" "i/o timeout"`,
+			wantDirection: recordError,
+			wantDevice:    "bridge 1",
+			wantData:      "i/o timeout",
+		},
+		{name: "not enough fields", line: `2025-01-01T12:00:00Z >`, wantErr: "not enough fields"},
+		{name: "invalid timestamp", line: `yesterday > "sim0" "QPIGS"`, wantErr: "cannot parse"},
+		{name: "unquoted device", line: `2025-01-01T12:00:00Z > sim0 "QPIGS"`, wantErr: "invalid device"},
+		{name: "unquoted frame", line: `2025-01-01T12:00:00Z > "sim0" QPIGS`, wantErr: "invalid frame"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			direction, device, data, err := parseRecordLine(tt.line)
+			checkErr(t, err, tt.wantErr)
+			if tt.wantErr != "" {
+				return
+			}
+
+			if direction != tt.wantDirection || device != tt.wantDevice || string(data) != tt.wantData {
+				t.Errorf("got %s %q %q, want %s %q %q", direction, device, data, tt.wantDirection, tt.wantDevice, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestRecorderStopsAfterWriteError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.rec")
+
+	rec, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.write("sim0", recordRequest, []byte("QPIGS"))
+
+	// Writes to the closed file fail
+	rec.f.Close()
+	rec.write("sim0", recordResponse, []byte("(NAK"))
+	if !rec.failed {
+		t.Fatal("recording was not stopped after a failed write")
+	}
+	rec.write("sim0", recordRequest, []byte("QPIRI"))
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n != 1 {
+		t.Errorf("got %d recorded lines, want 1", n)
+	}
+}
@@ -18,7 +18,11 @@ func (a *Application) Routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/healthz", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "OK", http.StatusOK) })
 	router.HandlerFunc(http.MethodPost, "/api/command/:command", a.handleCommand)
 	router.HandlerFunc(http.MethodGet, "/api/inverters", a.handleListInverters)
+	router.HandlerFunc(http.MethodPost, "/api/inverters/:serial/settings", a.handleApplySettings)
 	router.HandlerFunc(http.MethodPost, "/api/settings", a.handleGetCurrentSettings)
+	router.HandlerFunc(http.MethodGet, "/api/schema", a.handleGetSchema)
+	router.HandlerFunc(http.MethodPost, "/api/warnings", a.handleGetWarnings)
+	router.HandlerFunc(http.MethodPost, "/api/energy", a.handleGetEnergy)
 	router.ServeFiles("/control/*filepath", http.Dir("frontend/"))
 
 	router.HandlerFunc(http.MethodGet, "/", func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/marevers/energia/pkg/axpert"
+)
+
+// Types of settings
+const (
+	settingEnum   = "enum"
+	settingNumber = "number"
+
+	// A set of flags that are either on or off, by name
+	settingFlags = "flags"
+)
+
+// Returned when a setting is validated against the current settings before they were collected
+var errNoCurrentSettings = errors.New("current settings not available - please wait for next metrics collection cycle")
+
+// Represents a value that is not valid for a setting, as opposed to a failure to change the setting
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Represents the allowed range of a numeric setting
+type Range struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+
+	// Values must be a multiple of the step, 0 allows any value
+	Step float64 `json:"step,omitempty"`
+}
+
+// Represents a setting of the inverter
+type Setting struct {
+	// Key of the setting in the current settings
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Unit string `json:"unit,omitempty"`
+
+	// Allowed range of a numeric setting
+	Range *Range `json:"range,omitempty"`
+
+	// Whether the range applies to 48 V units and is scaled to the battery rating voltage of the inverter
+	BatteryScaled bool `json:"batteryScaled,omitempty"`
+
+	// Values allowed in addition to the range, which are not compared to other settings
+	Special []float64 `json:"special,omitempty"`
+
+	// Notes on the values that are allowed beyond the range
+	Description string `json:"description,omitempty"`
+
+	// Allowed values of an enum setting, or the names of the flags of a flags setting
+	Values []string `json:"values,omitempty"`
+
+	// Query returning the values the inverter allows, which are checked when the setting is changed
+	AllowedQuery string `json:"allowedQuery,omitempty"`
+
+	// Keys of the settings a numeric setting may not be lower or higher than
+	AtLeast []string `json:"atLeast,omitempty"`
+	AtMost  []string `json:"atMost,omitempty"`
+
+	// Values other settings must have for the setting to be changed, by key
+	Requires map[string]string `json:"requires,omitempty"`
+
+	// Query the setting is read from and control API command that changes it, empty if read-only
+	Query   string `json:"query"`
+	Command string `json:"command,omitempty"`
+
+	// Returns the value of the setting from a query result, or false if the result does not contain it
+	read func(input any) (any, bool)
+}
+
+// Returns a read function for settings contained in query results of type T
+func from[T any](fn func(T) any) func(any) (any, bool) {
+	return func(input any) (any, bool) {
+		t, ok := input.(T)
+		if !ok {
+			return nil, false
+		}
+
+		return fn(t), true
+	}
+}
+
+// Returns the names of the given values
+func names[T any](values []T, name func(T) string) []string {
+	ns := make([]string, 0, len(values))
+	for _, v := range values {
+		ns = append(ns, name(v))
+	}
+
+	return ns
+}
+
+// Schema of all settings in the current settings, in the order of the current settings
+var settingsSchema = []Setting{
+	{
+		Key: "outputSourcePriority", Name: "output source priority", Type: settingEnum,
+		Values: []string{"utility", "solar", "sbu"},
+		Query:  "QPIRI", Command: "setOutputPriority",
+		read: from(func(ri *axpert.RatingInfo) any { return mapOutputSourcePriority(ri.OutputSourcePriority) }),
+	},
+	{
+		Key: "chargerSourcePriority", Name: "charger source priority", Type: settingEnum,
+		Values: []string{"utilityfirst", "solarfirst", "solarandutility", "solaronly"},
+		Query:  "QPIRI", Command: "setChargerPriority",
+		read: from(func(ri *axpert.RatingInfo) any { return mapChargerSourcePriority(ri.ChargerSourcePriority) }),
+	},
+	{
+		Key: "deviceMode", Name: "device mode", Type: settingEnum,
+		Values: names(deviceModes, mapDeviceMode),
+		Query:  "QMOD",
+		read:   from(func(md string) any { return mapDeviceMode(md) }),
+	},
+	{
+		Key: "chargeSource", Name: "charge source", Type: settingEnum,
+		Values: []string{"utility", "solar"},
+		Query:  "QPGS0",
+		read:   from(func(pi *axpert.ParallelInfo) any { return mapChargeSource(pi.ACCharging) }),
+	},
+	{
+		Key: "batteryRechargeVoltage", Name: "battery recharge voltage", Type: settingNumber, Unit: "V",
+		Range:         &Range{Min: 44, Max: 51, Step: 1},
+		BatteryScaled: true,
+		AtLeast:       []string{"batteryCutoffVoltage"},
+		AtMost:        []string{"batteryRedischargeVoltage", "batteryFloatVoltage"},
+		Query:         "QPIRI", Command: "setBatteryRechgVoltage",
+		read: from(func(ri *axpert.RatingInfo) any { return ri.BatteryRechargeVoltage }),
+	},
+	{
+		Key: "batteryRedischargeVoltage", Name: "battery redischarge voltage", Type: settingNumber, Unit: "V",
+		Range:         &Range{Min: 48, Max: 58, Step: 1},
+		BatteryScaled: true,
+		// 0 charges the battery until it is full
+		Special: []float64{0},
+		AtLeast: []string{"batteryRechargeVoltage", "batteryCutoffVoltage"},
+		AtMost:  []string{"batteryFloatVoltage"},
+		Query:   "QPIRI", Command: "setBatteryRedischgVoltage",
+		read: from(func(ri *axpert.RatingInfo) any { return ri.BatteryRedischargeVoltage }),
+	},
+	{
+		Key: "batteryCutoffVoltage", Name: "battery cutoff voltage", Type: settingNumber, Unit: "V",
+		Range:         &Range{Min: 40, Max: 48, Step: 0.1},
+		BatteryScaled: true,
+		AtMost:        []string{"batteryRechargeVoltage", "batteryRedischargeVoltage"},
+		Requires:      map[string]string{"batteryType": "user"},
+		Query:         "QPIRI", Command: "setBatteryCutoffVoltage",
+		read: from(func(ri *axpert.RatingInfo) any { return ri.BatteryUnderVoltage }),
+	},
+	{
+		Key: "batteryFloatVoltage", Name: "battery float voltage", Type: settingNumber, Unit: "V",
+		Range:         &Range{Min: 48, Max: 58.4, Step: 0.1},
+		BatteryScaled: true,
+		AtLeast:       []string{"batteryRechargeVoltage", "batteryRedischargeVoltage"},
+		AtMost:        []string{"batteryBulkVoltage"},
+		Requires:      map[string]string{"batteryType": "user"},
+		Query:         "QPIRI", Command: "setBatteryFloatVoltage",
+		read: from(func(ri *axpert.RatingInfo) any { return ri.BatteryFloatVoltage }),
+	},
+	{
+		Key: "batteryBulkVoltage", Name: "battery bulk voltage", Type: settingNumber, Unit: "V",
+		Range:         &Range{Min: 48, Max: 58.4, Step: 0.1},
+		BatteryScaled: true,
+		AtLeast:       []string{"batteryFloatVoltage"},
+		Requires:      map[string]string{"batteryType": "user"},
+		Query:         "QPIRI", Command: "setBatteryBulkVoltage",
+		read: from(func(ri *axpert.RatingInfo) any { return ri.BatteryBulkVoltage }),
+	},
+	{
+		Key: "batteryRatingVoltage", Name: "battery rating voltage", Type: settingNumber, Unit: "V",
+		Query: "QPIRI",
+		read:  from(func(ri *axpert.RatingInfo) any { return ri.BatteryRatingVoltage }),
+	},
+	{
+		Key: "batteryType", Name: "battery type", Type: settingEnum,
+		Values: []string{"agm", "flooded", "user", "lithium"},
+		Query:  "QPIRI", Command: "setBatteryType",
+		read: from(func(ri *axpert.RatingInfo) any { return mapBatteryType(ri.BatteryType) }),
+	},
+	{
+		Key: "maxACChargeCurrent", Name: "maximum AC charge current", Type: settingNumber, Unit: "A",
+		Range:        &Range{Min: 0, Max: 255, Step: 1},
+		AllowedQuery: "QMUCHGCR",
+		Query:        "QPIRI", Command: "setMaxUtilityChargeCurrent",
+		read: from(func(ri *axpert.RatingInfo) any { return ri.MaxACChargingCurrent }),
+	},
+	{
+		Key: "maxChargeCurrent", Name: "maximum charge current", Type: settingNumber, Unit: "A",
+		Range:        &Range{Min: 0, Max: 255, Step: 1},
+		AllowedQuery: "QMCHGCR",
+		Query:        "QPIRI", Command: "setMaxChargeCurrent",
+		read: from(func(ri *axpert.RatingInfo) any { return ri.MaxChargingCurrent }),
+	},
+	{
+		Key: "gridRatingVoltage", Name: "grid rating voltage", Type: settingNumber, Unit: "V",
+		Query: "QPIRI",
+		read:  from(func(ri *axpert.RatingInfo) any { return ri.GridRatingVoltage }),
+	},
+	{
+		Key: "gridRatingCurrent", Name: "grid rating current", Type: settingNumber, Unit: "A",
+		Query: "QPIRI",
+		read:  from(func(ri *axpert.RatingInfo) any { return ri.GridRatingCurrent }),
+	},
+	{
+		Key: "outputRatingVoltage", Name: "output rating voltage", Type: settingNumber, Unit: "V",
+		Range: &Range{Min: 110, Max: 240, Step: 1},
+		Description: "The allowed values are inferred from the grid rating voltage (QPIRI), as the inverter does not report them: " +
+			"220, 230 and 240 V for 230 V inverters, 110, 120 and 127 V for 120 V inverters. " +
+			"The output rating voltage and frequency must be consistent with the grid rating voltage.",
+		Requires: map[string]string{"deviceMode": "standby"},
+		Query:    "QPIRI", Command: "setOutputVoltage",
+		read: from(func(ri *axpert.RatingInfo) any { return ri.ACOutputRatingVoltage }),
+	},
+	{
+		Key: "outputRatingFrequency", Name: "output rating frequency", Type: settingNumber, Unit: "Hz",
+		Range:    &Range{Min: 50, Max: 60, Step: 10},
+		Requires: map[string]string{"deviceMode": "standby"},
+		Query:    "QPIRI", Command: "setOutputFrequency",
+		read: from(func(ri *axpert.RatingInfo) any { return ri.ACOutputRatingFrequency }),
+	},
+	{
+		Key: "outputRatingCurrent", Name: "output rating current", Type: settingNumber, Unit: "A",
+		Query: "QPIRI",
+		read:  from(func(ri *axpert.RatingInfo) any { return ri.ACOutputRatingCurrent }),
+	},
+	{
+		Key: "outputRatingApparentPower", Name: "output rating apparent power", Type: settingNumber, Unit: "VA",
+		Query: "QPIRI",
+		read:  from(func(ri *axpert.RatingInfo) any { return ri.ACOutputRatingApparentPower }),
+	},
+	{
+		Key: "outputRatingActivePower", Name: "output rating active power", Type: settingNumber, Unit: "W",
+		Query: "QPIRI",
+		read:  from(func(ri *axpert.RatingInfo) any { return ri.ACOutputRatingActivePower }),
+	},
+	{
+		Key: "inputVoltageRange", Name: "input voltage range", Type: settingEnum,
+		Values: []string{"appliance", "ups"},
+		Query:  "QPIRI",
+		read:   from(func(ri *axpert.RatingInfo) any { return mapInputVoltageRange(ri.InputVoltageRange) }),
+	},
+	{
+		Key: "machineType", Name: "machine type", Type: settingEnum,
+		Values: []string{"gridtie", "offgrid", "hybrid", "offgrid2trackers", "offgrid3trackers"},
+		Query:  "QPIRI",
+		read:   from(func(ri *axpert.RatingInfo) any { return mapMachineType(ri.MachineType) }),
+	},
+	{
+		Key: "topology", Name: "topology", Type: settingEnum,
+		Values: []string{"transformerless", "transformer"},
+		Query:  "QPIRI",
+		read:   from(func(ri *axpert.RatingInfo) any { return mapTopology(ri.Topology) }),
+	},
+	{
+		Key: "outputMode", Name: "output mode", Type: settingEnum,
+		Values: names(outputModes, mapOutputMode),
+		Query:  "QOPM",
+		read: func(input any) (any, bool) {
+			switch inp := input.(type) {
+			case *axpert.RatingInfo:
+				return mapOutputMode(inp.OutputMode), true
+			case axpert.OutputMode:
+				return mapOutputMode(inp), true
+			default:
+				return nil, false
+			}
+		},
+	},
+	{
+		Key: "parallelMaxNumber", Name: "parallel max number", Type: settingNumber,
+		Query: "QPIRI",
+		read:  from(func(ri *axpert.RatingInfo) any { return ri.ParallelMaxNumber }),
+	},
+	{
+		Key: "parallelPVOK", Name: "parallel PV OK condition", Type: settingEnum,
+		Values: []string{"any", "all"},
+		Query:  "QPIRI",
+		read:   from(func(ri *axpert.RatingInfo) any { return mapParallelPVOK(ri.ParallelPVOK) }),
+	},
+	{
+		Key: "pvPowerBalance", Name: "PV power balance", Type: settingEnum,
+		Values: []string{"chargecurrent", "chargepowerplusload"},
+		Query:  "QPIRI",
+		read:   from(func(ri *axpert.RatingInfo) any { return mapPVPowerBalance(ri.PVPowerBalance) }),
+	},
+	{
+		Key: "flags", Name: "device flags", Type: settingFlags,
+		Values: names(deviceFlags, func(df deviceFlag) string { return df.Name }),
+		Query:  "QFLAG", Command: "setFlag",
+		read: from(func(fl map[axpert.DeviceFlag]axpert.FlagStatus) any { return flagStates(fl) }),
+	},
+}
+
+// Returns the setting with the given key
+func findSetting(key string) (*Setting, error) {
+	for i := range settingsSchema {
+		if settingsSchema[i].Key == key {
+			return &settingsSchema[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown setting: %s", key)
+}
+
+// Returns the setting changed by the given control API command, nil if there is none
+func findCommandSetting(command string) *Setting {
+	for i := range settingsSchema {
+		if settingsSchema[i].Command == command {
+			return &settingsSchema[i]
+		}
+	}
+
+	return nil
+}
+
+// Returns the field of the current settings with the given JSON key
+func (cs *CurrentSettings) field(key string) (reflect.Value, error) {
+	v := reflect.ValueOf(cs).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		tag, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if tag == key {
+			return v.Field(i), nil
+		}
+	}
+
+	return reflect.Value{}, fmt.Errorf("unknown setting: %s", key)
+}
+
+// Returns the value of a setting
+func (cs *CurrentSettings) Get(key string) (any, error) {
+	f, err := cs.field(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Interface(), nil
+}
+
+// Sets the value of a setting, converting numbers to the type of the field
+func (cs *CurrentSettings) Set(key string, value any) error {
+	f, err := cs.field(key)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(value)
+	if !v.CanConvert(f.Type()) || (v.Kind() == reflect.String) != (f.Kind() == reflect.String) {
+		return fmt.Errorf("invalid value for setting %s: %v", key, value)
+	}
+	f.Set(v.Convert(f.Type()))
+
+	return nil
+}
+
+// Returns a copy of the current settings
+func (cs *CurrentSettings) clone() *CurrentSettings {
+	c := *cs
+	c.Flags = maps.Clone(cs.Flags)
+	if c.Flags == nil {
+		c.Flags = make(map[string]bool)
+	}
+
+	return &c
+}
+
+// Returns a numeric setting as float64
+func (cs *CurrentSettings) number(key string) (float64, error) {
+	f, err := cs.field(key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := toNumber(f)
+	if err != nil {
+		return 0, fmt.Errorf("setting %s is not a number", key)
+	}
+
+	return n, nil
+}
+
+// Validates a value for the setting against its allowed range or values and the current settings
+func (s *Setting) Validate(value any, cs *CurrentSettings) error {
+	var f float64
+	switch s.Type {
+	case settingEnum:
+		v, ok := value.(string)
+		if !ok || !slices.Contains(s.Values, v) {
+			return fmt.Errorf("%s must be one of %s", s.Name, strings.Join(s.Values, ", "))
+		}
+	case settingFlags:
+		v, ok := value.(map[string]bool)
+		if !ok {
+			return fmt.Errorf("%s must be a set of flags", s.Name)
+		}
+		for name := range v {
+			if !slices.Contains(s.Values, name) {
+				return fmt.Errorf("%s can only contain %s", s.Name, strings.Join(s.Values, ", "))
+			}
+		}
+	default:
+		var err error
+		if f, err = toNumber(reflect.ValueOf(value)); err != nil {
+			return fmt.Errorf("%s must be a number", s.Name)
+		}
+
+		if slices.Contains(s.Special, f) {
+			// Special values are not compared to other settings
+			return s.checkRequires(cs)
+		}
+
+		if err := s.checkRange(f, cs); err != nil {
+			return err
+		}
+	}
+
+	if err := s.checkRequires(cs); err != nil {
+		return err
+	}
+	if len(s.AtLeast) == 0 && len(s.AtMost) == 0 {
+		return nil
+	}
+	if cs == nil {
+		return errNoCurrentSettings
+	}
+
+	for _, key := range s.AtLeast {
+		other, err := cs.number(key)
+		if err != nil {
+			return err
+		}
+		if isSpecial(key, other) {
+			continue
+		}
+		if f < other {
+			return fmt.Errorf("%s may not be lower than %s", s.Name, settingName(key))
+		}
+	}
+	for _, key := range s.AtMost {
+		other, err := cs.number(key)
+		if err != nil {
+			return err
+		}
+		if isSpecial(key, other) {
+			continue
+		}
+		if f > other {
+			return fmt.Errorf("%s may not exceed %s", s.Name, settingName(key))
+		}
+	}
+
+	return nil
+}
+
+// Checks that the values other settings must have for the setting to be changed are set
+func (s *Setting) checkRequires(cs *CurrentSettings) error {
+	if len(s.Requires) == 0 {
+		return nil
+	}
+	if cs == nil {
+		return errNoCurrentSettings
+	}
+
+	for key, want := range s.Requires {
+		got, err := cs.Get(key)
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("%s can only be changed if %s is %s, not %v", s.Name, settingName(key), want, got)
+		}
+	}
+
+	return nil
+}
+
+// Checks a numeric value against the allowed range of the setting. The range of battery scaled
+// settings is scaled to the battery rating voltage of the inverter, if it is known: the allowed values
+// are the values allowed for 48 V units, scaled and rounded to the resolution of the protocol, e.g.
+// 11.3 V for 45 V on a 12 V unit.
+func (s *Setting) checkRange(f float64, cs *CurrentSettings) error {
+	r := s.Range
+	if r == nil {
+		return nil
+	}
+
+	if !s.BatteryScaled || cs == nil || cs.BatteryRatingVoltage <= 0 || cs.BatteryRatingVoltage == 48 {
+		if f < r.Min || f > r.Max || (r.Step > 0 && !isMultiple(f, r.Step)) {
+			return fmt.Errorf("%s must be %s between %g and %g %s", s.Name, r.stepDescription(), r.Min, r.Max, s.Unit)
+		}
+		return nil
+	}
+
+	k := float64(cs.BatteryRatingVoltage) / 48
+	lo, hi := scaleVoltage(r.Min, k), scaleVoltage(r.Max, k)
+
+	// The value of a 48 V unit the value is scaled from
+	v := f / k
+	if r.Step > 0 {
+		v = math.Round(v/r.Step) * r.Step
+	}
+
+	if f >= lo && f <= hi && scaleVoltage(v, k) == f {
+		return nil
+	}
+
+	// Steps that are coarser than the 0.1 V resolution of the protocol leave a few values, which are listed
+	if r.Step*k > 0.1 {
+		values := make([]string, 0)
+		for v := r.Min; v <= r.Max+r.Step/2; v += r.Step {
+			values = append(values, fmt.Sprintf("%g", scaleVoltage(v, k)))
+		}
+		return fmt.Errorf("%s must be one of %s %s", s.Name, strings.Join(values, ", "), s.Unit)
+	}
+
+	return fmt.Errorf("%s must be a multiple of 0.1 between %g and %g %s", s.Name, lo, hi, s.Unit)
+}
+
+// Scales a voltage of a 48 V unit by k and rounds it to the 0.1 V resolution of the protocol
+func scaleVoltage(v, k float64) float64 {
+	return math.Round(v*k*10) / 10
+}
+
+// Returns true if v is a special value of the setting with the given key
+func isSpecial(key string, v float64) bool {
+	s, err := findSetting(key)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(s.Special, v)
+}
+
+// Converts a numeric value to float64. Floats are rounded to 3 decimals, so float32 settings such
+// as 56.4 V compare equal to the same value given as float64.
+func toNumber(v reflect.Value) (float64, error) {
+	switch {
+	case v.CanFloat():
+		return math.Round(v.Float()*1e3) / 1e3, nil
+	case v.CanInt():
+		return float64(v.Int()), nil
+	default:
+		return 0, errors.New("not a number")
+	}
+}
+
+// Returns the name of the setting with the given key, or the key if it is unknown
+func settingName(key string) string {
+	s, err := findSetting(key)
+	if err != nil {
+		return key
+	}
+
+	return s.Name
+}
+
+// Describes the values allowed by the step of a range
+func (r *Range) stepDescription() string {
+	switch r.Step {
+	case 0:
+		return "a number"
+	case 1:
+		return "a whole number"
+	default:
+		return fmt.Sprintf("a multiple of %g", r.Step)
+	}
+}
+
+// Returns true if f is a multiple of step, allowing for rounding errors
+func isMultiple(f, step float64) bool {
+	n := f / step
+	return math.Abs(n-math.Round(n)) < 1e-6
+}
+
+// Validates a value for the setting with the given key against the schema and the current settings
+func validateSetting(key string, value any, cs *CurrentSettings) error {
+	s, err := findSetting(key)
+	if err != nil {
+		return err
+	}
+
+	err = s.Validate(value, cs)
+	if err != nil && !errors.Is(err, errNoCurrentSettings) {
+		return &ValidationError{Err: err}
+	}
+
+	return err
+}
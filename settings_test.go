@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/marevers/energia/pkg/axpert"
+)
+
+// Returns the current settings of a 48 V inverter with a user-defined battery in standby mode
+func testSettings() *CurrentSettings {
+	return &CurrentSettings{
+		OutputSourcePriority:      "sbu",
+		DeviceMode:                "standby",
+		BatteryRatingVoltage:      48,
+		BatteryType:               "user",
+		BatteryCutoffVoltage:      42,
+		BatteryRechargeVoltage:    46,
+		BatteryRedischargeVoltage: 54,
+		BatteryFloatVoltage:       54,
+		BatteryBulkVoltage:        56.4,
+		MaxChargeCurrent:          60,
+		OutputRatingVoltage:       230,
+		OutputRatingFrequency:     50,
+		Flags:                     map[string]bool{"buzzer": true},
+	}
+}
+
+// Changes the current settings to the ones of a 24 V inverter
+func use24V(cs *CurrentSettings) {
+	cs.BatteryRatingVoltage = 24
+	cs.BatteryCutoffVoltage = 21
+	cs.BatteryRechargeVoltage = 23
+	cs.BatteryRedischargeVoltage = 27
+	cs.BatteryFloatVoltage = 27
+	cs.BatteryBulkVoltage = 28.2
+}
+
+// Changes the current settings to the ones of a 12 V inverter
+func use12V(cs *CurrentSettings) {
+	cs.BatteryRatingVoltage = 12
+	cs.BatteryCutoffVoltage = 10.5
+	cs.BatteryRechargeVoltage = 11.5
+	cs.BatteryRedischargeVoltage = 13.5
+	cs.BatteryFloatVoltage = 13.5
+	cs.BatteryBulkVoltage = 14.1
+}
+
+func TestSettingValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   any
+		modify  func(cs *CurrentSettings)
+		wantErr string
+	}{
+		// Enums
+		{name: "enum value", key: "outputSourcePriority", value: "solar"},
+		{name: "unknown enum value", key: "outputSourcePriority", value: "grid", wantErr: "must be one of utility, solar, sbu"},
+		{name: "enum of wrong type", key: "outputSourcePriority", value: 1, wantErr: "must be one of"},
+
+		// Flags
+		{name: "known flags", key: "flags", value: map[string]bool{"buzzer": false, "backlight": true}},
+		{name: "unknown flag", key: "flags", value: map[string]bool{"turbo": true}, wantErr: "can only contain buzzer"},
+		{name: "flags of wrong type", key: "flags", value: "buzzer", wantErr: "must be a set of flags"},
+
+		// Ranges and steps
+		{name: "number of wrong type", key: "batteryRechargeVoltage", value: "46", wantErr: "must be a number"},
+		{name: "whole number", key: "batteryRechargeVoltage", value: 45},
+		{name: "below minimum", key: "batteryRechargeVoltage", value: 43, wantErr: "must be a whole number between 44 and 51 V"},
+		{name: "above maximum", key: "batteryRechargeVoltage", value: 52, wantErr: "between 44 and 51 V"},
+		{name: "not a whole number", key: "batteryRechargeVoltage", value: 45.5, wantErr: "must be a whole number"},
+		{name: "float32 multiple of step", key: "batteryBulkVoltage", value: float32(56.4)},
+		{name: "float64 multiple of step", key: "batteryBulkVoltage", value: 56.4},
+		{name: "float32 at maximum", key: "batteryBulkVoltage", value: float32(58.4)},
+		{name: "not a multiple of step", key: "batteryBulkVoltage", value: 56.45, wantErr: "must be a multiple of 0.1 between 48 and 58.4 V"},
+		{name: "multiple of step 10", key: "outputRatingFrequency", value: 60},
+		{name: "not a multiple of step 10", key: "outputRatingFrequency", value: 55, wantErr: "must be a multiple of 10"},
+
+		// Ranges scaled to the battery rating voltage
+		{name: "scaled range", key: "batteryFloatVoltage", value: 27, modify: use24V},
+		{name: "above scaled maximum", key: "batteryBulkVoltage", value: 30, modify: use24V, wantErr: "between 24 and 29.2 V"},
+		{name: "below scaled minimum", key: "batteryCutoffVoltage", value: 19.5, modify: use24V, wantErr: "between 20 and 24 V"},
+		{name: "scaled step", key: "batteryRechargeVoltage", value: 23.5, modify: use24V},
+		{name: "not a scaled step", key: "batteryRechargeVoltage", value: 23.2, modify: use24V, wantErr: "must be one of 22, 22.5, 23, 23.5, 24, 24.5, 25, 25.5 V"},
+		{name: "scaled step rounded", key: "batteryRechargeVoltage", value: 11.3, modify: use12V},
+		{name: "scaled step not rounded", key: "batteryRechargeVoltage", value: 11.25, modify: use12V, wantErr: "must be one of 11, 11.3, 11.5, 11.8, 12, 12.3, 12.5, 12.8 V"},
+		{name: "scaled resolution", key: "batteryFloatVoltage", value: 13.6, modify: use12V},
+		{name: "below scaled resolution", key: "batteryFloatVoltage", value: 13.55, modify: use12V, wantErr: "must be a multiple of 0.1 between 12 and 14.6 V"},
+
+		// Special values
+		{name: "special value", key: "batteryRedischargeVoltage", value: 0},
+		{name: "special value of other setting", key: "batteryRechargeVoltage", value: 48, modify: func(cs *CurrentSettings) { cs.BatteryRedischargeVoltage = 0 }},
+		{name: "special value of other setting only", key: "batteryRechargeVoltage", value: 45, modify: func(cs *CurrentSettings) {
+			cs.BatteryRedischargeVoltage = 0
+			cs.BatteryCutoffVoltage = 46
+		}, wantErr: "battery recharge voltage may not be lower than battery cutoff voltage"},
+
+		// Relations to other settings
+		{name: "at least other setting", key: "batteryFloatVoltage", value: 54},
+		{name: "lower than other setting", key: "batteryFloatVoltage", value: 53, wantErr: "battery float voltage may not be lower than battery redischarge voltage"},
+		{name: "at most other setting", key: "batteryFloatVoltage", value: float32(56.4)},
+		{name: "higher than other setting", key: "batteryFloatVoltage", value: 56.5, wantErr: "battery float voltage may not exceed battery bulk voltage"},
+		{
+			name: "required setting", key: "batteryFloatVoltage", value: 54,
+			modify:  func(cs *CurrentSettings) { cs.BatteryType = "agm" },
+			wantErr: "battery float voltage can only be changed if battery type is user, not agm",
+		},
+		{
+			name: "required device mode", key: "outputRatingVoltage", value: 230,
+			modify:  func(cs *CurrentSettings) { cs.DeviceMode = "battery" },
+			wantErr: "output rating voltage can only be changed if device mode is standby, not battery",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := findSetting(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cs := testSettings()
+			if tt.modify != nil {
+				tt.modify(cs)
+			}
+
+			checkErr(t, s.Validate(tt.value, cs), tt.wantErr)
+		})
+	}
+}
+
+func TestSettingValidateWithoutCurrentSettings(t *testing.T) {
+	// Settings without relations to other settings are validated on their own
+	s, _ := findSetting("outputSourcePriority")
+	if err := s.Validate("utility", nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	s, _ = findSetting("batteryFloatVoltage")
+	if err := s.Validate(54, nil); !errors.Is(err, errNoCurrentSettings) {
+		t.Errorf("got error %v, want %v", err, errNoCurrentSettings)
+	}
+}
+
+func TestCurrentSettingsSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   any
+		want    any
+		wantErr string
+	}{
+		{name: "string", key: "batteryType", value: "agm", want: "agm"},
+		{name: "float64 to float32", key: "batteryFloatVoltage", value: 54.5, want: float32(54.5)},
+		{name: "int to float32", key: "batteryFloatVoltage", value: 55, want: float32(55)},
+		{name: "float64 to int", key: "maxChargeCurrent", value: float64(80), want: 80},
+		{name: "flags", key: "flags", value: map[string]bool{"backlight": true}, want: map[string]bool{"backlight": true}},
+		{name: "number to string", key: "batteryType", value: 1, wantErr: "invalid value for setting batteryType"},
+		{name: "string to number", key: "maxChargeCurrent", value: "80", wantErr: "invalid value for setting maxChargeCurrent"},
+		{name: "bool to number", key: "maxChargeCurrent", value: true, wantErr: "invalid value"},
+		{name: "unknown setting", key: "turbo", value: 1, wantErr: "unknown setting: turbo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := testSettings()
+
+			err := cs.Set(tt.key, tt.value)
+			checkErr(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+
+			got, err := cs.Get(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalValues(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateCurrentSettings(t *testing.T) {
+	ri := &axpert.RatingInfo{
+		GridRatingVoltage:         230,
+		ACOutputRatingVoltage:     230,
+		ACOutputRatingFrequency:   50,
+		BatteryRatingVoltage:      48,
+		BatteryRechargeVoltage:    46,
+		BatteryUnderVoltage:       42,
+		BatteryBulkVoltage:        56.4,
+		BatteryFloatVoltage:       54,
+		BatteryType:               axpert.User,
+		MaxACChargingCurrent:      30,
+		MaxChargingCurrent:        60,
+		InputVoltageRange:         axpert.UPS,
+		OutputSourcePriority:      axpert.OutputSBUFirst,
+		ChargerSourcePriority:     axpert.ChargerSolarFirst,
+		ParallelMaxNumber:         9,
+		MachineType:               axpert.OffGrid,
+		Topology:                  axpert.Transformer,
+		OutputMode:                axpert.SingleMachine,
+		BatteryRedischargeVoltage: 54,
+		ParallelPVOK:              axpert.AllInvertersConnected,
+		PVPowerBalance:            axpert.InputPowerIsChargedPowerPlusLoadPower,
+	}
+
+	tests := []struct {
+		name    string
+		input   any
+		want    map[string]any
+		wantErr string
+	}{
+		{
+			name:  "rating information",
+			input: ri,
+			want: map[string]any{
+				"outputSourcePriority":  "sbu",
+				"chargerSourcePriority": "solarfirst",
+				"batteryCutoffVoltage":  float32(42),
+				"batteryBulkVoltage":    float32(56.4),
+				"batteryType":           "user",
+				"maxChargeCurrent":      60,
+				"outputRatingVoltage":   float32(230),
+				"inputVoltageRange":     "ups",
+				"machineType":           "offgrid",
+				"topology":              "transformer",
+				"outputMode":            "single",
+				"parallelPVOK":          "all",
+				"pvPowerBalance":        "chargepowerplusload",
+			},
+		},
+		{name: "device mode", input: "B", want: map[string]any{"deviceMode": "battery"}},
+		{name: "parallel information", input: &axpert.ParallelInfo{ACCharging: true}, want: map[string]any{"chargeSource": "utility"}},
+		{name: "output mode", input: axpert.Phase2, want: map[string]any{"outputMode": "phase2"}},
+		{
+			name:  "device flags",
+			input: map[axpert.DeviceFlag]axpert.FlagStatus{axpert.Buzzer: axpert.FlagDisabled, axpert.BacklightOn: axpert.FlagEnabled},
+			want:  map[string]any{"flags": map[string]bool{"buzzer": false, "backlight": true}},
+		},
+		{name: "unrecognized device mode", input: "X", wantErr: "unrecognized device mode"},
+		{name: "unknown input type", input: 42, wantErr: "unknown input type: int"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := &Inverter{}
+
+			checkErr(t, inv.UpdateCurrentSettings(tt.input), tt.wantErr)
+
+			for key, want := range tt.want {
+				got, err := inv.CurrentSettings.Get(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !equalValues(got, want) {
+					t.Errorf("%s: got %#v, want %#v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Fails the test if err does not contain want, or if err is not nil while want is empty
+func checkErr(t *testing.T, err error, want string) {
+	t.Helper()
+
+	switch {
+	case want == "" && err != nil:
+		t.Errorf("unexpected error: %s", err)
+	case want != "" && err == nil:
+		t.Errorf("expected error containing %q", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Errorf("got error %q, want it to contain %q", err, want)
+	}
+}
+
+// Returns true if two setting values are equal, comparing flags by content
+func equalValues(got, want any) bool {
+	if w, ok := want.(map[string]bool); ok {
+		g, ok := got.(map[string]bool)
+		return ok && maps.Equal(g, w)
+	}
+
+	return got == want
+}
+
+func TestBatteryTypeOverrides(t *testing.T) {
+	tests := []struct {
+		name   string
+		bt     string
+		modify func(cs *CurrentSettings)
+		want   []SettingOverride
+	}{
+		{
+			name: "48 V", bt: "flooded",
+			want: []SettingOverride{{Key: "batteryBulkVoltage", Current: float32(56.4), New: float32(58.4)}},
+		},
+		{
+			name: "scaled", bt: "flooded", modify: use24V,
+			want: []SettingOverride{{Key: "batteryBulkVoltage", Current: float32(28.2), New: float32(29.2)}},
+		},
+		{
+			name: "unknown battery rating voltage", bt: "agm",
+			modify: func(cs *CurrentSettings) { cs.BatteryRatingVoltage = 0 },
+			want: []SettingOverride{
+				{Key: "batteryBulkVoltage", Current: float32(56.4), New: nil},
+				{Key: "batteryFloatVoltage", Current: float32(54), New: nil},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := testSettings()
+			if tt.modify != nil {
+				tt.modify(cs)
+			}
+
+			got, err := batteryTypeOverrides(cs, tt.bt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got overrides %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
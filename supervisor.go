@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/marevers/energia/pkg/connector"
+	log "github.com/sirupsen/logrus"
+)
+
+// Periodically drops the connectors of inverters that keep failing, reopens disconnected inverters
+// and discovers inverters that were connected through USB after startup
+func (a *Application) superviseInverters(t time.Duration) {
+	tck := time.NewTicker(t)
+	defer tck.Stop()
+
+	// USB HID paths that did not answer as an inverter, so they are not probed every cycle
+	probed := make(map[string]bool)
+
+	for range tck.C {
+		a.dropFailingConnectors()
+		a.reopenInverters()
+		a.discoverUSBInverters(probed)
+	}
+}
+
+// Closes the connectors of inverters that failed the configured number of collection cycles in a row
+func (a *Application) dropFailingConnectors() {
+	for _, inv := range a.inverterList() {
+		inv.mu.Lock()
+		if inv.Connector != nil && inv.failures >= *maxFailures {
+			log.Warnf("Dropping connector of inverter with serialno '%s' on %s after %d failed collection cycles", inv.SerialNo, inv.Device, inv.failures)
+
+			inv.closeConnector()
+			inv.linkMu.Lock()
+			inv.Connector = nil
+			inv.linkMu.Unlock()
+			inv.failures = 0
+		}
+		inv.mu.Unlock()
+	}
+}
+
+// Reopens the devices of disconnected inverters
+func (a *Application) reopenInverters() {
+	for _, inv := range a.inverterList() {
+		inv.mu.Lock()
+		disconnected, open, device := inv.Connector == nil, inv.reopen, inv.Device
+		inv.mu.Unlock()
+
+		if !disconnected || open == nil {
+			continue
+		}
+
+		cr, err := open()
+		if err != nil {
+			log.Debugf("failed to reopen %s: %s", device, err)
+			continue
+		}
+
+		if err := a.attachConnector(cr, device, open); err != nil {
+			log.Debugln(err)
+		}
+	}
+}
+
+// Probes USB HID devices that are not in use by an inverter
+func (a *Application) discoverUSBInverters(probed map[string]bool) {
+	paths, err := connector.GetUSBPaths()
+	if err != nil {
+		log.Debugln("failed to enumerate USB devices:", err)
+		return
+	}
+
+	inUse := make(map[string]bool)
+	for _, inv := range a.inverterList() {
+		inv.mu.Lock()
+		if inv.Connector != nil {
+			inUse[inv.Device] = true
+		}
+		inv.mu.Unlock()
+	}
+
+	present := make(map[string]bool)
+	for _, path := range paths {
+		present[path] = true
+
+		if inUse[path] || probed[path] {
+			continue
+		}
+
+		open := usbOpener(path)
+		cr, err := open()
+		if err != nil {
+			log.Debugln(err)
+			continue
+		}
+
+		if err := a.attachConnector(cr, path, open); err != nil {
+			log.Debugln(err)
+			probed[path] = true
+		}
+	}
+
+	// Forget paths that disappeared, another device may appear under the same path
+	for path := range probed {
+		if !present[path] {
+			delete(probed, path)
+		}
+	}
+}
+
+// Matches an opened connector to an inverter by serial number. A disconnected inverter with the same
+// serial number gets the connector, otherwise a new inverter is added. The connector is closed if the
+// inverter is already connected through another device. Returns an error and closes the connector if
+// the device does not answer as an inverter. A batch or control command in progress is finished
+// before the connector is swapped, so it does not continue on another connector.
+func (a *Application) attachConnector(cr connector.Connector, device string, open opener) error {
+	inv, err := newInverter(cr, device, a.Recorder)
+	if err != nil {
+		cr.Close()
+		return fmt.Errorf("no inverter found on %s: %w", device, err)
+	}
+	inv.reopen = open
+
+	for _, existing := range a.inverterList() {
+		if existing.SerialNo != inv.SerialNo {
+			continue
+		}
+
+		existing.batch.Lock()
+		defer existing.batch.Unlock()
+		existing.mu.Lock()
+		defer existing.mu.Unlock()
+
+		if existing.Connector != nil {
+			log.Debugf("inverter with serialno '%s' on %s is already connected on %s", inv.SerialNo, device, existing.Device)
+			inv.closeConnector()
+			return nil
+		}
+
+		log.Infof("Reconnected inverter with serialno '%s' on %s", inv.SerialNo, device)
+		existing.linkMu.Lock()
+		existing.Connector = inv.Connector
+		existing.Device = device
+		// The firmware may have been updated while the inverter was disconnected
+		existing.Identity = inv.Identity
+		existing.linkMu.Unlock()
+
+		existing.reopen = open
+		existing.failures = 0
+		existing.busy = inv.busy
+		existing.unsupported = inv.unsupported
+		existing.breaker.reset()
+		exportBreakerState(a.Prometheus, existing)
+		a.exportIdentity(existing)
+
+		return nil
+	}
+
+	log.Infof("Discovered inverter with serialno '%s' on %s", inv.SerialNo, device)
+	a.addInverter(inv)
+
+	return nil
+}
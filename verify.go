@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/marevers/energia/pkg/axpert"
+	"github.com/marevers/energia/pkg/connector"
+)
+
+// Defines the signature for functions reading a setting back from the inverter after a command
+// changed it. The inverter lock is held while they are called.
+type CommandReadBack func(app *Application, inv *Inverter, c *exchangeConnector, s *Setting, req CommandRequest) (any, error)
+
+// Maps command names to their read-back functions, for commands that are not read back from the
+// query of their setting
+var commandReadBacks = map[string]CommandReadBack{
+	"setMaxChargeCurrent": readBackMaxChargeCurrent,
+}
+
+// Reads the setting changed by a command back from the inverter. The query the setting is read from
+// is repeated, which updates the current settings and the metrics of its query group.
+func (a *Application) readBack(s *Setting, req CommandRequest) (any, error) {
+	inv, err := findInverterBySerial(a, req.SerialNo)
+	if err != nil {
+		return nil, err
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	c, err := a.conn(inv)
+	if err != nil {
+		return nil, err
+	}
+
+	if rb, ok := commandReadBacks[s.Command]; ok {
+		return rb(a, inv, c, s, req)
+	}
+
+	return a.readBackSetting(inv, c, s, req)
+}
+
+// Repeats the query of the query group the setting is read from and returns the setting from the
+// refreshed current settings
+func (a *Application) readBackSetting(inv *Inverter, c *exchangeConnector, s *Setting, req CommandRequest) (any, error) {
+	var group *queryGroup
+	for i := range queryGroups {
+		if queryGroups[i].Query == s.Query {
+			group = &queryGroups[i]
+			break
+		}
+	}
+	if group == nil {
+		return nil, fmt.Errorf("no query group reads %s", s.Query)
+	}
+
+	if err := group.Collect(a, inv, c, []string{inv.SerialNo}); err != nil {
+		return nil, err
+	}
+	if inv.CurrentSettings == nil {
+		return nil, fmt.Errorf("%s did not return %s", s.Query, s.Name)
+	}
+
+	// Flags are read back individually
+	if s.Type == settingFlags {
+		on, ok := inv.CurrentSettings.Flags[req.Flag]
+		if !ok {
+			return nil, fmt.Errorf("%s did not return device flag %s", s.Query, req.Flag)
+		}
+		return on, nil
+	}
+
+	return inv.CurrentSettings.Get(s.Key)
+}
+
+// Reads the maximum charge current back. Units of the parallel cluster other than the inverter itself
+// only report it in their parallel information (QPGS).
+func readBackMaxChargeCurrent(app *Application, inv *Inverter, c *exchangeConnector, s *Setting, req CommandRequest) (any, error) {
+	if req.ParallelID == nil || *req.ParallelID == inv.parallelID() {
+		return app.readBackSetting(inv, c, s, req)
+	}
+
+	id := *req.ParallelID
+	pi, err := observe(c, fmt.Sprintf("QPGS%d", id), func(c connector.Connector) (*axpert.ParallelInfo, error) {
+		return axpert.ParallelDeviceInfo(c, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if l, ok := inv.parallelUnits[pi.SerialNumber]; ok {
+		app.exportParallelUnit(l, pi)
+	}
+
+	return pi.MaxChargerCurrent, nil
+}
+
+// Returns true if the value read back matches the value of the command request
+func matchesRequest(s *Setting, req CommandRequest, readBack any) bool {
+	switch s.Type {
+	case settingEnum:
+		return readBack == req.Value
+	case settingFlags:
+		on, err := parseFlagValue(req.Value)
+		return err == nil && readBack == on
+	default:
+		f, err := strconv.ParseFloat(req.Value, 64)
+		if err != nil {
+			return false
+		}
+		want, _ := toNumber(reflect.ValueOf(f))
+		got, err := toNumber(reflect.ValueOf(readBack))
+		return err == nil && got == want
+	}
+}
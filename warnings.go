@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/marevers/energia/pkg/axpert"
+)
+
+// Severities of warnings
+const (
+	severityFault   = "fault"
+	severityWarning = "warning"
+)
+
+// Represents a warning flag of the warning status (QPIWS)
+type warningFlag struct {
+	Warning axpert.DeviceWarning
+	Name    string
+
+	// Severity of the warning, empty if the flag is a fault when the inverter fault flag is set
+	// and a warning otherwise
+	Severity string
+}
+
+// Warning flags in the order of the warning status, reserved flags are left out
+var warningFlags = []warningFlag{
+	{axpert.WarnInverterFault, "inverter_fault", severityFault},
+	{axpert.WarnBusOver, "bus_over", severityFault},
+	{axpert.WarnBusUnder, "bus_under", severityFault},
+	{axpert.WarnBusSoftFail, "bus_soft_fail", severityFault},
+	{axpert.WarnLineFail, "line_fail", severityWarning},
+	{axpert.WarnOPVShort, "opv_short", severityWarning},
+	{axpert.WarnInverterVoltageLow, "inverter_voltage_low", severityFault},
+	{axpert.WarnInverterVoltageHigh, "inverter_voltage_high", severityFault},
+	{axpert.WarnOverTemperature, "over_temperature", ""},
+	{axpert.WarnFanLocked, "fan_locked", ""},
+	{axpert.WarnBatteryVoltageHigh, "battery_voltage_high", ""},
+	{axpert.WarnBatteryLowAlarm, "battery_low_alarm", severityWarning},
+	{axpert.WarnBatteryShutdown, "battery_shutdown", severityWarning},
+	{axpert.WarnOverload, "overload", ""},
+	{axpert.WarnEEPROMFault, "eeprom_fault", severityWarning},
+	{axpert.WarnInverterOverCurrent, "inverter_over_current", severityFault},
+	{axpert.WarnInverterSoftFail, "inverter_soft_fail", severityFault},
+	{axpert.WarnSelfTestFail, "self_test_fail", severityFault},
+	{axpert.WarnOPDCVoltageOver, "op_dc_voltage_over", severityFault},
+	{axpert.WarnBatteryOpen, "battery_open", severityFault},
+	{axpert.WarnCurrentSensorFail, "current_sensor_fail", severityFault},
+	{axpert.WarnBatteryShort, "battery_short", severityFault},
+	{axpert.WarnPowerLimit, "power_limit", severityWarning},
+	{axpert.WarnPVVoltageHigh, "pv_voltage_high", severityWarning},
+	{axpert.WarnMPPTOverloadFault, "mppt_overload_fault", severityWarning},
+	{axpert.WarnMPPTOverloadWarning, "mppt_overload_warning", severityWarning},
+	{axpert.WarnBatteryTooLowToCharge, "battery_too_low_to_charge", severityWarning},
+	{axpert.WarnPVVoltageHigh2, "pv2_voltage_high", severityWarning},
+	{axpert.WarnMPPTOverloadFault2, "mppt2_overload_fault", severityWarning},
+	{axpert.WarnMPPTOverloadWarning2, "mppt2_overload_warning", severityWarning},
+	{axpert.WarnBatteryTooLowToCharge2, "battery_too_low_to_charge_pv2", severityWarning},
+	{axpert.WarnPVVoltageHigh3, "pv3_voltage_high", severityWarning},
+	{axpert.WarnMPPTOverloadFault3, "mppt3_overload_fault", severityWarning},
+	{axpert.WarnMPPTOverloadWarning3, "mppt3_overload_warning", severityWarning},
+	{axpert.WarnBatteryTooLowToCharge3, "battery_too_low_to_charge_pv3", severityWarning},
+}
+
+// Represents an active warning for the API
+type ActiveWarning struct {
+	Warning  string `json:"warning"`
+	Severity string `json:"severity"`
+}
+
+// Returns the severity of the warning flag given whether the inverter fault flag is set
+func (wf warningFlag) severity(inverterFault bool) string {
+	if wf.Severity != "" {
+		return wf.Severity
+	}
+
+	if inverterFault {
+		return severityFault
+	}
+
+	return severityWarning
+}
+
+// Returns the active warnings of a warning status
+func activeWarnings(wns []axpert.DeviceWarning) []ActiveWarning {
+	active := make(map[axpert.DeviceWarning]bool)
+	for _, wn := range wns {
+		active[wn] = true
+	}
+
+	warnings := make([]ActiveWarning, 0)
+	for _, wf := range warningFlags {
+		if active[wf.Warning] {
+			warnings = append(warnings, ActiveWarning{
+				Warning:  wf.Name,
+				Severity: wf.severity(active[axpert.WarnInverterFault]),
+			})
+		}
+	}
+
+	return warnings
+}